@@ -29,6 +29,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/checkpoint-restore/go-criu/v7"
@@ -43,11 +44,25 @@ var cli struct {
 	Debug bool `help:"Enable debug mode."`
 
 	Run Run `cmd:"" help:"Run given command wrapped by crik."`
+
+	Check Check `cmd:"" help:"Check whether the node and the container are ready for checkpoint and restore."`
+
+	Analyze Analyze `cmd:"" help:"Report the resources of a live process tree that would break the checkpoint."`
+
+	Init Init `cmd:"" hidden:"" help:"Run given command as the child of the init process of a PID namespace."`
+
+	Supervise Supervise `cmd:"" hidden:"" help:"Run the processes of given manifest as one process tree."`
+
+	ActionScript ActionScript `cmd:"" hidden:"" help:"Act on restore events. Called by criu as an action script."`
 }
 
 func main() {
 	ctx := kong.Parse(&cli)
 	if err := ctx.Run(); err != nil {
+		var exitErr cexec.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		fmt.Printf("failed to run the command: %s", err.Error())
 		os.Exit(1)
 	}
@@ -57,6 +72,12 @@ type Run struct {
 	Args []string `arg:"" optional:"" passthrough:"" name:"command" help:"Command and its arguments to run. Required if --image-dir is not given or empty."`
 
 	ConfigPath string `type:"path" default:"/etc/crik/config.yaml" help:"Path to the configuration file."`
+
+	Check bool `help:"Fail if any of the preflight checks fails. Otherwise, the failed checks are only reported."`
+
+	Manifest string `type:"path" help:"Path to a process manifest to run several commands together as one process tree instead of a single command."`
+
+	AnalyzeInterval time.Duration `help:"If given, the process tree is analyzed periodically and the resources that would break the checkpoint are reported."`
 }
 
 func (r *Run) Run() error {
@@ -64,38 +85,150 @@ func (r *Run) Run() error {
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("failed to read configuration: %w", err)
 	}
+	results := cexec.RunChecks(cfg, cexec.CheckOptions{})
+	if r.Check {
+		cexec.PrintChecks(os.Stdout, results)
+		if !cexec.ChecksPassed(results) {
+			return fmt.Errorf("preflight checks failed")
+		}
+	} else if !cexec.ChecksPassed(results) {
+		// Failures are reported so that they are found before the checkpoint is needed, but they are not fatal since
+		// the application can still run without checkpoints.
+		fmt.Println("Some preflight checks failed, checkpoint or restore may not work:")
+		var failed []cexec.CheckResult
+		for _, c := range results {
+			if !c.Passed {
+				failed = append(failed, c)
+			}
+		}
+		cexec.PrintChecks(os.Stdout, failed)
+	}
+	if cfg.ImageDir != "" {
+		// Without an image directory, there is nothing to checkpoint or restore.
+		if err := cexec.CheckPrivileges(cfg); err != nil {
+			return err
+		}
+	}
 	willRestore, err := shouldRestore(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to check if restore is needed: %w", err)
 	}
 	if willRestore {
 		fmt.Printf("A checkpoint has been found in %s. Restoring.\n", cfg.ImageDir)
-		if err := cexec.RestoreWithCmd(cfg.ImageDir); err != nil {
+		if err := cexec.RestoreWithCmd(cfg.ImageDir, cfg); err != nil {
 			return fmt.Errorf("failed to restore: %w", err)
 		}
 		return nil
 	}
+	if r.Manifest != "" {
+		if len(r.Args) > 0 {
+			return fmt.Errorf("command cannot be given together with --manifest")
+		}
+		if cfg.TTY {
+			// Each process runs in its own process group and none of them is the foreground one of the terminal, so
+			// the ones reading from or writing to it would be stopped.
+			return fmt.Errorf("tty cannot be used together with --manifest")
+		}
+		// Fail early instead of in the supervisor.
+		if _, err := cexec.ReadProcessManifest(r.Manifest); err != nil {
+			return err
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get path of crik executable: %w", err)
+		}
+		// The supervisor is the root of the process tree, so all processes are checkpointed together.
+		r.Args = []string{exe, "supervise", "--manifest", r.Manifest}
+	}
 	if len(r.Args) == 0 {
-		return fmt.Errorf("command is required when there is no checkpoint to restore, i.e. --image-dir is not given or empty")
+		return fmt.Errorf("command or --manifest is required when there is no checkpoint to restore, i.e. --image-dir is not given or empty")
 	}
-	// Make sure the PID is a high number so that it's not taken up during restore.
-	lastPidPath := "/proc/sys/kernel/ns_last_pid"
-	if err := os.WriteFile(lastPidPath, []byte("9000"), 0644); err != nil {
-		return fmt.Errorf("failed to write to %s: %w", lastPidPath, err)
+	if cfg.RootfsDiff && cfg.ImageDir != "" {
+		if err := cexec.WriteRootfsBaseline(cfg.ImageDir); err != nil {
+			return fmt.Errorf("failed to record rootfs baseline: %w", err)
+		}
 	}
-
-	cmd := exec.Command(r.Args[0], r.Args[1:]...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid:       true,
-		Unshareflags: syscall.CLONE_NEWIPC,
+	namespaces := cexec.NamespacesOrDefault(cfg.Namespaces)
+	attr, err := cexec.NewSysProcAttr(namespaces)
+	if err != nil {
+		return fmt.Errorf("failed to configure namespaces: %w", err)
+	}
+	var cmd *exec.Cmd
+	if cexec.HasNamespace(namespaces, cexec.NamespacePID) {
+		// PIDs in a new PID namespace start from 1 and are restored in a fresh namespace, so they never collide.
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get path of crik executable: %w", err)
+		}
+		cmd = exec.Command(exe, append([]string{"init", "--"}, r.Args...)...)
+	} else {
+		switch {
+		case cexec.SupportsSetTID():
+			fmt.Printf("The kernel supports clone3 with set_tid, criu will use it to restore the PIDs.\n")
+		case cexec.IsLastPIDWritable():
+			// Make sure the PID is a high number so that it's not taken up during restore.
+			if err := os.WriteFile(cexec.LastPIDPath, []byte("9000"), 0644); err != nil {
+				return fmt.Errorf("failed to write to %s: %w", cexec.LastPIDPath, err)
+			}
+		default:
+			// CheckPrivileges makes sure either of the above is possible if a checkpoint will be taken.
+			fmt.Printf("%s is not writable and the kernel doesn't support clone3 with set_tid.\n", cexec.LastPIDPath)
+		}
+		cmd = exec.Command(r.Args[0], r.Args[1:]...)
+	}
+	cmd.SysProcAttr = attr
+	if cfg.Notification != nil {
+		cmd.Env = append(os.Environ(), cfg.Notification.Environment()...)
 	}
 	cmd.Stdin = nil
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
+	cmd.ExtraFiles = cexec.InheritedFiles(cfg.InheritedFds)
+	var relay *cexec.StdioRelay
+	var pty *cexec.Pty
+	if cfg.TTY {
+		if pty, err = cexec.OpenPty(); err != nil {
+			return fmt.Errorf("failed to allocate terminal: %w", err)
+		}
+		defer pty.Close()
+		pty.Attach(cmd)
+	} else {
+		if relay, err = cexec.NewStdioRelay(cfg.Stdio); err != nil {
+			return fmt.Errorf("failed to set up stdio relay: %w", err)
+		}
+		if relay != nil {
+			defer relay.Close()
+			relay.Attach(cmd)
+		}
+	}
+	if err := cexec.StartCommand(cmd, namespaces); err != nil {
 		return fmt.Errorf("failed to start command: %w", err)
 	}
+	switch {
+	case pty != nil:
+		pty.Start()
+	case relay != nil:
+		relay.Start()
+	}
+	// wait waits for the command to exit and its output to be relayed.
+	wait := func() error {
+		err := cmd.Wait()
+		switch {
+		case pty != nil:
+			pty.Wait()
+		case relay != nil:
+			relay.Wait()
+		}
+		return err
+	}
 	fmt.Printf("Command started with PID %d\n", cmd.Process.Pid)
+	stopPrestaging := func() {}
+	if cfg.ImageDir != "" && cfg.PrestageIntervalSeconds > 0 && len(cfg.AdditionalPaths) > 0 {
+		stopPrestaging = cexec.StartPrestaging(cfg)
+	}
+	if r.AnalyzeInterval > 0 {
+		go analyzePeriodically(cmd.Process.Pid, cfg, r.AnalyzeInterval)
+	}
 	if cfg.ImageDir != "" {
 		fmt.Printf("Setting up SIGTERM handler to take checkpoint in %s\n", cfg.ImageDir)
 		signal.Notify(signalChan, syscall.SIGTERM)
@@ -120,9 +253,10 @@ func (r *Run) Run() error {
 					if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
 						return fmt.Errorf("failed to send SIGTERM to the process: %w", err)
 					}
-					return cmd.Wait()
+					return wait()
 				}
 			}
+			stopPrestaging()
 			duration, err := cexec.TakeCheckpoint(criu.MakeCriu(), cmd.Process.Pid, cfg)
 			if err != nil {
 				return fmt.Errorf("failed to take checkpoint: %w", err)
@@ -130,7 +264,124 @@ func (r *Run) Run() error {
 			fmt.Printf("Checkpoint taken in %s\n", duration)
 		}
 	}
-	return cmd.Wait()
+	return wait()
+}
+
+type Check struct {
+	ConfigPath string `type:"path" default:"/etc/crik/config.yaml" help:"Path to the configuration file."`
+
+	Output string `enum:"text,json" default:"text" help:"Output format of the report. One of text or json."`
+
+	MinFreeSpace int `default:"1024" help:"Minimum free space in MiB required in the image directory."`
+}
+
+func (c *Check) Run() error {
+	cfg, err := cexec.ReadConfiguration(c.ConfigPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read configuration: %w", err)
+	}
+	results := cexec.RunChecks(cfg, cexec.CheckOptions{MinFreeBytes: uint64(c.MinFreeSpace) << 20})
+	switch c.Output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return fmt.Errorf("failed to encode report: %w", err)
+		}
+	default:
+		cexec.PrintChecks(os.Stdout, results)
+	}
+	if !cexec.ChecksPassed(results) {
+		return fmt.Errorf("preflight checks failed")
+	}
+	return nil
+}
+
+type Analyze struct {
+	PID int `required:"" help:"PID of the root of the process tree to analyze."`
+
+	ConfigPath string `type:"path" default:"/etc/crik/config.yaml" help:"Path to the configuration file."`
+
+	Output string `enum:"text,json" default:"text" help:"Output format of the report. One of text or json."`
+}
+
+func (a *Analyze) Run() error {
+	cfg, err := cexec.ReadConfiguration(a.ConfigPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read configuration: %w", err)
+	}
+	result, err := cexec.Analyze(a.PID, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to analyze: %w", err)
+	}
+	switch a.Output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return fmt.Errorf("failed to encode report: %w", err)
+		}
+	default:
+		result.Print(os.Stdout)
+	}
+	if result.HasErrors() {
+		return fmt.Errorf("process tree cannot be checkpointed")
+	}
+	return nil
+}
+
+// analyzePeriodically reports the resources that would break the checkpoint as soon as they show up.
+func analyzePeriodically(pid int, cfg cexec.Configuration, interval time.Duration) {
+	reported := map[string]bool{}
+	lastErr := ""
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		result, err := cexec.Analyze(pid, cfg)
+		if err != nil {
+			// Errors are usually transient, e.g. a process exits while it's inspected, so the analysis goes on and
+			// the same error is logged only once in a row.
+			if err.Error() != lastErr {
+				fmt.Printf("failed to analyze process tree: %s\n", err.Error())
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+		for _, f := range result.Findings {
+			if reported[f.Key()] {
+				continue
+			}
+			reported[f.Key()] = true
+			fmt.Printf("crik analyze: [%s] pid %d %s -> %s: %s\n", f.Severity, f.PID, f.Resource, f.Target, f.Reason)
+		}
+	}
+}
+
+type Init struct {
+	Args []string `arg:"" passthrough:"" name:"command" help:"Command and its arguments to run."`
+}
+
+func (i *Init) Run() error {
+	return cexec.RunInit(i.Args)
+}
+
+type Supervise struct {
+	Manifest string `required:"" type:"path" help:"Path to the process manifest."`
+}
+
+func (s *Supervise) Run() error {
+	m, err := cexec.ReadProcessManifest(s.Manifest)
+	if err != nil {
+		return err
+	}
+	return cexec.RunSupervisor(m)
+}
+
+type ActionScript struct{}
+
+func (a *ActionScript) Run() error {
+	return cexec.RunActionScript()
 }
 
 func shouldRestore(cfg cexec.Configuration) (bool, error) {
@@ -0,0 +1,326 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// OverLimitPolicy decides what happens when the files of an additional path exceed its size limit.
+type OverLimitPolicy string
+
+const (
+	// OverLimitPolicySkip leaves the entry out of the checkpoint entirely. It is the default.
+	OverLimitPolicySkip OverLimitPolicy = "skip"
+	// OverLimitPolicyPartial includes the most recently modified files that fit in the limit.
+	OverLimitPolicyPartial OverLimitPolicy = "partial"
+	// OverLimitPolicyFail fails the checkpoint.
+	OverLimitPolicyFail OverLimitPolicy = "fail"
+)
+
+// AdditionalPath is an entry of AdditionalPaths. It can be given either as a string, which is the same as giving only
+// Path, or as an object.
+type AdditionalPath struct {
+	// Path is the path of a file or a directory whose whole tree is included. It can also be a glob pattern, e.g.
+	// /root/.cache/**/*.json, in which "**" matches any number of directories and the other segments are matched
+	// with the syntax of path.Match.
+	Path string `json:"path"`
+
+	// Exclude is the list of glob patterns of the files and directories to leave out. Patterns without a slash are
+	// matched against the base name, e.g. "*.tmp", and the others against the full path.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// MaxSize is the limit of the total size of the included files, e.g. 2Gi. Unlimited if not given.
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+
+	// OverLimit is the policy applied when the files exceed MaxSize, either "skip", the default, "partial" or
+	// "fail".
+	OverLimit OverLimitPolicy `json:"overLimit,omitempty"`
+}
+
+// UnmarshalJSON accepts both a plain path and an object.
+func (a *AdditionalPath) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err == nil {
+		*a = AdditionalPath{Path: p}
+		return nil
+	}
+	type plain AdditionalPath
+	return json.Unmarshal(b, (*plain)(a))
+}
+
+// root returns the longest leading part of Path without glob characters, i.e. the directory to walk.
+func (a AdditionalPath) root() string {
+	segs := strings.Split(filepath.Clean(a.Path), "/")
+	for i, s := range segs {
+		if strings.ContainsAny(s, "*?[") {
+			if i <= 1 {
+				return "/"
+			}
+			return strings.Join(segs[:i], "/")
+		}
+	}
+	return filepath.Clean(a.Path)
+}
+
+// excluded returns true if the given path matches one of the exclusion patterns.
+func (a AdditionalPath) excluded(p string) bool {
+	for _, pattern := range a.Exclude {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, filepath.Base(p)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// selection is the result of evaluating an additional path against the filesystem.
+type selection struct {
+	root  string
+	files map[string]bool
+	// dirs is the set of directories to copy, i.e. the ancestors of the files and, if the whole tree is included, the
+	// empty directories in it.
+	dirs map[string]bool
+	size int64
+	// dropped is the number of files left out due to the size limit.
+	dropped int
+}
+
+// include is the filter given to copyTree.
+func (s selection) include(p string, isDir bool) bool {
+	if isDir {
+		return s.dirs[p]
+	}
+	return s.files[p]
+}
+
+// addFile includes the given file together with its ancestors up to the root.
+func (s selection) addFile(p string) {
+	s.files[p] = true
+	for d := filepath.Dir(p); isUnder(d, s.root) && !s.dirs[d]; d = filepath.Dir(d) {
+		s.dirs[d] = true
+		if d == s.root {
+			break
+		}
+	}
+}
+
+// selectFiles walks the root of the entry and returns the non-directory files that it includes, applying the size
+// limit with the configured policy. The walk stays on the filesystem of the root, since other mounts are either
+// external or handled separately, skips the given directory, i.e. the image directory, and the ones crik cannot read.
+func (a AdditionalPath) selectFiles(skip string) (selection, error) {
+	s := selection{root: a.root(), files: map[string]bool{}, dirs: map[string]bool{}}
+	glob := s.root != filepath.Clean(a.Path)
+	type candidate struct {
+		path string
+		info fs.FileInfo
+	}
+	var candidates []candidate
+	var walkedDirs []string
+	var rootSt unix.Stat_t
+	if err := unix.Stat(s.root, &rootSt); err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return s, nil
+		}
+		return selection{}, err
+	}
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && p != s.root {
+			var st unix.Stat_t
+			if err := unix.Lstat(p, &st); err != nil {
+				return nil
+			}
+			if st.Dev != rootSt.Dev || (skip != "" && p == skip) {
+				return filepath.SkipDir
+			}
+		}
+		if a.excluded(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			walkedDirs = append(walkedDirs, p)
+			return nil
+		}
+		if glob && !matchGlob(a.Path, p) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// The file is removed during the walk.
+			return nil
+		}
+		candidates = append(candidates, candidate{path: p, info: info})
+		return nil
+	})
+	if err != nil {
+		return selection{}, err
+	}
+	limit := int64(-1)
+	if a.MaxSize != nil {
+		limit = a.MaxSize.Value()
+	}
+	var total int64
+	for _, c := range candidates {
+		if c.info.Mode().IsRegular() {
+			total += c.info.Size()
+		}
+	}
+	if limit < 0 || total <= limit {
+		for _, c := range candidates {
+			s.addFile(c.path)
+		}
+		if !glob {
+			// The whole tree is included, so are its empty directories.
+			for _, d := range walkedDirs {
+				s.dirs[d] = true
+			}
+		}
+		s.size = total
+		return s, nil
+	}
+	switch a.OverLimit {
+	case OverLimitPolicyFail:
+		return selection{}, fmt.Errorf("files of %s are %d bytes which exceeds the limit of %s", a.Path, total, a.MaxSize.String())
+	case OverLimitPolicyPartial:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].info.ModTime().After(candidates[j].info.ModTime())
+		})
+		for _, c := range candidates {
+			size := int64(0)
+			if c.info.Mode().IsRegular() {
+				size = c.info.Size()
+			}
+			if s.size+size > limit {
+				s.dropped++
+				continue
+			}
+			s.size += size
+			s.addFile(c.path)
+		}
+	default:
+		s.dropped = len(candidates)
+	}
+	return s, nil
+}
+
+// syncAdditionalPaths copies the files of the given entries into the given extra files directory, copying only the
+// ones that changed since the last call. Entries whose roots overlap are copied together so that the files of one are
+// not removed as stale by the other.
+func syncAdditionalPaths(entries []AdditionalPath, extraFilesDir, imageDir string, workers int) error {
+	var selections []selection
+	for _, a := range entries {
+		s, err := a.selectFiles(filepath.Clean(imageDir))
+		if err != nil {
+			return err
+		}
+		if s.dropped > 0 {
+			fmt.Printf("Left out %d files of %s since they exceed the size limit of %s.\n", s.dropped, a.Path, a.MaxSize.String())
+		}
+		selections = append(selections, s)
+	}
+	include := func(p string, isDir bool) bool {
+		for _, s := range selections {
+			if isDir && isUnder(s.root, p) {
+				// An ancestor of the root of another entry.
+				return true
+			}
+			if isUnder(p, s.root) && s.include(p, isDir) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range selections {
+		nested := false
+		for _, other := range selections {
+			if other.root != s.root && isUnder(s.root, other.root) {
+				nested = true
+			}
+		}
+		if nested {
+			// Copied as part of the outer entry.
+			continue
+		}
+		dst := filepath.Join(extraFilesDir, s.root)
+		if _, err := os.Lstat(s.root); os.IsNotExist(err) {
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyTree(s.root, dst, copyOptions{incremental: true, workers: max(workers, 1), include: include}); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", s.root, err)
+		}
+	}
+	return nil
+}
+
+// isUnder returns true if p is the same as or under dir.
+func isUnder(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// matchGlob reports whether the path matches the pattern, in which "**" matches any number of path segments and the
+// other segments are matched with path.Match.
+func matchGlob(pattern, p string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(p, "/"), "/"))
+}
+
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
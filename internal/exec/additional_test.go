@@ -0,0 +1,252 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/root/.cache/*.json", path: "/root/.cache/a.json", want: true},
+		{pattern: "/root/.cache/*.json", path: "/root/.cache/sub/a.json", want: false},
+		{pattern: "/root/.cache/**/*.json", path: "/root/.cache/a.json", want: true},
+		{pattern: "/root/.cache/**/*.json", path: "/root/.cache/x/y/a.json", want: true},
+		{pattern: "/root/.cache/**/*.json", path: "/root/.cache/x/y/a.txt", want: false},
+		{pattern: "/root/**", path: "/root/a/b", want: true},
+		{pattern: "/root/**", path: "/root", want: true},
+		{pattern: "/root/**", path: "/rootfs/a", want: false},
+		{pattern: "/**/node_modules", path: "/app/web/node_modules", want: true},
+		{pattern: "/**/node_modules", path: "/app/web/node_modules/x", want: false},
+		{pattern: "/app/?.log", path: "/app/a.log", want: true},
+		{pattern: "/app/[ab].log", path: "/app/c.log", want: false},
+		{pattern: "/app/a.log", path: "/app/a.log/", want: true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAdditionalPathUnmarshalJSON(t *testing.T) {
+	maxSize := resource.MustParse("2Gi")
+	tests := []struct {
+		name    string
+		json    string
+		want    AdditionalPath
+		wantErr bool
+	}{
+		{
+			name: "string",
+			json: `"/root/.cache"`,
+			want: AdditionalPath{Path: "/root/.cache"},
+		},
+		{
+			name: "object",
+			json: `{"path": "/root/.cache", "exclude": ["*.tmp"], "maxSize": "2Gi", "overLimit": "partial"}`,
+			want: AdditionalPath{Path: "/root/.cache", Exclude: []string{"*.tmp"}, MaxSize: &maxSize,
+				OverLimit: OverLimitPolicyPartial},
+		},
+		{
+			name:    "invalid",
+			json:    `42`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got AdditionalPath
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.MaxSize != nil && tt.want.MaxSize != nil && got.MaxSize.Cmp(*tt.want.MaxSize) == 0 {
+				got.MaxSize = tt.want.MaxSize
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdditionalPathsUnmarshalJSONMixed(t *testing.T) {
+	var got []AdditionalPath
+	if err := json.Unmarshal([]byte(`["/a", {"path": "/b", "overLimit": "fail"}]`), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []AdditionalPath{{Path: "/a"}, {Path: "/b", OverLimit: OverLimitPolicyFail}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "data")
+	now := time.Now()
+	// Files from the oldest to the newest.
+	files := []struct {
+		name string
+		size int
+	}{
+		{name: "a.json", size: 100},
+		{name: "sub/b.json", size: 200},
+		{name: "c.tmp", size: 300},
+	}
+	for i, f := range files {
+		p := filepath.Join(root, f.name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, f.size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-len(files)) * time.Hour)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "images"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "images", "pages-1.img"), make([]byte, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	quantity := func(s string) *resource.Quantity {
+		q := resource.MustParse(s)
+		return &q
+	}
+	tests := []struct {
+		name        string
+		entry       AdditionalPath
+		wantFiles   []string
+		wantDirs    []string
+		wantSize    int64
+		wantDropped int
+		wantErr     bool
+	}{
+		{
+			name:      "whole tree",
+			entry:     AdditionalPath{Path: root},
+			wantFiles: []string{"a.json", "c.tmp", "sub/b.json"},
+			wantDirs:  []string{"", "empty", "sub"},
+			wantSize:  600,
+		},
+		{
+			name:      "exclude",
+			entry:     AdditionalPath{Path: root, Exclude: []string{"*.tmp"}},
+			wantFiles: []string{"a.json", "sub/b.json"},
+			wantDirs:  []string{"", "empty", "sub"},
+			wantSize:  300,
+		},
+		{
+			name:      "glob",
+			entry:     AdditionalPath{Path: root + "/**/*.json"},
+			wantFiles: []string{"a.json", "sub/b.json"},
+			wantDirs:  []string{"", "sub"},
+			wantSize:  300,
+		},
+		{
+			name:      "within limit",
+			entry:     AdditionalPath{Path: root, MaxSize: quantity("600"), OverLimit: OverLimitPolicyFail},
+			wantFiles: []string{"a.json", "c.tmp", "sub/b.json"},
+			wantDirs:  []string{"", "empty", "sub"},
+			wantSize:  600,
+		},
+		{
+			name:        "over limit with default policy",
+			entry:       AdditionalPath{Path: root, MaxSize: quantity("400")},
+			wantDropped: 3,
+		},
+		{
+			name:        "over limit with skip",
+			entry:       AdditionalPath{Path: root, MaxSize: quantity("400"), OverLimit: OverLimitPolicySkip},
+			wantDropped: 3,
+		},
+		{
+			name:        "over limit with partial",
+			entry:       AdditionalPath{Path: root, MaxSize: quantity("400"), OverLimit: OverLimitPolicyPartial},
+			wantFiles:   []string{"a.json", "c.tmp"},
+			wantDirs:    []string{""},
+			wantSize:    400,
+			wantDropped: 1,
+		},
+		{
+			name:    "over limit with fail",
+			entry:   AdditionalPath{Path: root, MaxSize: quantity("400"), OverLimit: OverLimitPolicyFail},
+			wantErr: true,
+		},
+		{
+			name:  "missing root",
+			entry: AdditionalPath{Path: filepath.Join(root, "missing")},
+		},
+	}
+	rel := func(set map[string]bool) []string {
+		var result []string
+		for p := range set {
+			r, err := filepath.Rel(root, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r == "." {
+				r = ""
+			}
+			result = append(result, r)
+		}
+		slices.Sort(result)
+		return result
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.entry.selectFiles(filepath.Join(root, "images"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := rel(s.files); !slices.Equal(got, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", got, tt.wantFiles)
+			}
+			if got := rel(s.dirs); !slices.Equal(got, tt.wantDirs) {
+				t.Errorf("dirs = %v, want %v", got, tt.wantDirs)
+			}
+			if s.size != tt.wantSize || s.dropped != tt.wantDropped {
+				t.Errorf("size, dropped = %d, %d, want %d, %d", s.size, s.dropped, tt.wantSize, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity tells whether a finding is expected to break the dump.
+type Severity string
+
+// Severities of findings.
+const (
+	// SeverityError means the dump or the restore will fail.
+	SeverityError Severity = "error"
+	// SeverityWarning means the dump or the restore may fail or the restored process may behave differently.
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a resource of the process tree that criu may not be able to handle.
+type Finding struct {
+	PID        int      `json:"pid"`
+	Resource   string   `json:"resource"`
+	Target     string   `json:"target"`
+	Severity   Severity `json:"severity"`
+	Reason     string   `json:"reason"`
+	Suggestion string   `json:"suggestion,omitempty"`
+}
+
+// Key returns a string that identifies the finding across analyses.
+func (f Finding) Key() string {
+	return fmt.Sprintf("%d/%s/%s", f.PID, f.Resource, f.Target)
+}
+
+// Analysis is the result of inspecting a live process tree.
+type Analysis struct {
+	// PIDs is the list of processes in the tree.
+	PIDs []int `json:"pids"`
+
+	// FileDescriptors is the number of file descriptors inspected.
+	FileDescriptors int `json:"fileDescriptors"`
+
+	// Mappings is the number of file-backed memory mappings inspected.
+	Mappings int `json:"mappings"`
+
+	// Findings is the list of resources that may break the dump.
+	Findings []Finding `json:"findings"`
+}
+
+// HasErrors returns true if any of the findings will break the dump.
+func (a Analysis) HasErrors() bool {
+	for _, f := range a.Findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes a human-readable report of the analysis.
+func (a Analysis) Print(w io.Writer) {
+	fmt.Fprintf(w, "Inspected %d processes, %d file descriptors and %d mappings.\n", len(a.PIDs), a.FileDescriptors, a.Mappings)
+	if len(a.Findings) == 0 {
+		fmt.Fprintln(w, "No resources that would break the dump are found.")
+		return
+	}
+	for _, f := range a.Findings {
+		fmt.Fprintf(w, "[%s] pid %d %s -> %s: %s\n", strings.ToUpper(string(f.Severity)), f.PID, f.Resource, f.Target, f.Reason)
+		if f.Suggestion != "" {
+			fmt.Fprintf(w, "    suggestion: %s\n", f.Suggestion)
+		}
+	}
+}
+
+// ProcessTree returns the given PID and all of its descendants.
+func ProcessTree(pid int) ([]int, error) {
+	result := []int{pid}
+	for i := 0; i < len(result); i++ {
+		tasks, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(result[i]), "task"))
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("failed to read tasks of %d: %w", pid, err)
+			}
+			// The process exited in the meantime.
+			continue
+		}
+		for _, t := range tasks {
+			b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(result[i]), "task", t.Name(), "children"))
+			if err != nil {
+				continue
+			}
+			for _, c := range strings.Fields(string(b)) {
+				child, err := strconv.Atoi(c)
+				if err != nil {
+					continue
+				}
+				result = append(result, child)
+			}
+		}
+	}
+	return result, nil
+}
+
+// analyzer holds the state shared across the processes of the tree.
+type analyzer struct {
+	configuration Configuration
+	externals     []DirectoryMount
+	unixSockets   map[uint32]UnixSocket
+	treeSockets   map[uint32]bool
+	analysis      Analysis
+}
+
+// Analyze walks /proc for the process tree rooted at the given PID and reports every file descriptor, memory mapping
+// and socket that criu is not expected to handle with the given configuration.
+func Analyze(pid int, cfg Configuration) (Analysis, error) {
+	pids, err := ProcessTree(pid)
+	if err != nil {
+		return Analysis{}, err
+	}
+	a := &analyzer{
+		configuration: cfg,
+		treeSockets:   map[uint32]bool{},
+		analysis:      Analysis{PIDs: pids},
+	}
+	if a.externals, err = ExternalMounts(cfg); err != nil {
+		return Analysis{}, fmt.Errorf("failed to find external mounts: %w", err)
+	}
+	// A failure here only makes the Unix socket analysis less precise.
+	a.unixSockets, _ = ListUnixSockets()
+	fds := map[int]map[int]string{}
+	for _, p := range pids {
+		fds[p] = readFds(p)
+		for _, target := range fds[p] {
+			if inode, ok := socketInode(target); ok {
+				a.treeSockets[inode] = true
+			}
+		}
+	}
+	for _, p := range pids {
+		nums := make([]int, 0, len(fds[p]))
+		for n := range fds[p] {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		for _, n := range nums {
+			a.analysis.FileDescriptors++
+			a.analyzeFd(p, n, fds[p][n])
+		}
+		a.analyzeMappings(p)
+	}
+	if !cfg.DisableInotifyDetection {
+		a.analyzeInotifyWatches(pids)
+	}
+	if !HasNamespace(NamespacesOrDefault(cfg.Namespaces), NamespaceIPC) {
+		a.analyzeSysVIPC(pids)
+	}
+	return a.analysis, nil
+}
+
+func (a *analyzer) analyzeInotifyWatches(pids []int) {
+	paths, err := DetectInotifyIncompatiblePaths(pids)
+	if err != nil {
+		a.add(Finding{
+			PID:      pids[0],
+			Resource: "inotify",
+			Severity: SeverityWarning,
+			Reason:   fmt.Sprintf("failed to resolve inotify watches: %s", err.Error()),
+		})
+		return
+	}
+	for _, p := range paths {
+		a.add(Finding{
+			PID:      pids[0],
+			Resource: "inotify",
+			Target:   p,
+			Severity: SeverityWarning,
+			Reason:   "watched path is on an overlay filesystem and will be removed before dump",
+		})
+	}
+}
+
+// analyzeSysVIPC reports the SysV shared memory segments and message queues created or last used by the process tree,
+// which criu dumps only as part of an IPC namespace.
+func (a *analyzer) analyzeSysVIPC(pids []int) {
+	inTree := map[int]bool{}
+	for _, p := range pids {
+		inTree[p] = true
+	}
+	for _, ipc := range []struct {
+		file     string
+		resource string
+		// pidColumns are the columns of the PIDs that created or last used the object.
+		pidColumns []int
+	}{
+		{file: "/proc/sysvipc/shm", resource: "sysv shm", pidColumns: []int{4, 5}},
+		{file: "/proc/sysvipc/msg", resource: "sysv msg", pidColumns: []int{5, 6}},
+	} {
+		b, err := os.ReadFile(ipc.file)
+		if err != nil {
+			continue
+		}
+		// The first line is the header.
+		lines := strings.Split(string(b), "\n")
+		for _, line := range lines[min(1, len(lines)):] {
+			fields := strings.Fields(line)
+			if len(fields) <= ipc.pidColumns[1] {
+				continue
+			}
+			for _, col := range ipc.pidColumns {
+				pid, err := strconv.Atoi(fields[col])
+				if err != nil || !inTree[pid] {
+					continue
+				}
+				a.add(Finding{
+					PID:        pid,
+					Resource:   ipc.resource,
+					Target:     "id " + fields[1],
+					Severity:   SeverityError,
+					Reason:     "SysV IPC objects are dumped only within an ipc namespace",
+					Suggestion: "add ipc to namespaces",
+				})
+				break
+			}
+		}
+	}
+}
+
+func (a *analyzer) add(f Finding) {
+	a.analysis.Findings = append(a.analysis.Findings, f)
+}
+
+func (a *analyzer) analyzeFd(pid, fd int, target string) {
+	f := Finding{PID: pid, Resource: fmt.Sprintf("fd %d", fd), Target: target}
+	switch {
+	case target == "anon_inode:[io_uring]":
+		f.Severity = SeverityError
+		f.Reason = "criu cannot dump io_uring instances"
+		f.Suggestion = "disable io_uring in the application, e.g. UV_USE_IO_URING=0 for Node.js"
+	case target == "anon_inode:[perf_event]":
+		f.Severity = SeverityError
+		f.Reason = "criu cannot dump perf events"
+	case target == "anon_inode:[userfaultfd]":
+		f.Severity = SeverityError
+		f.Reason = "criu cannot dump userfaultfd"
+	case strings.HasPrefix(target, "anon_inode:bpf"):
+		f.Severity = SeverityWarning
+		f.Reason = "criu supports only some types of BPF maps and no BPF programs"
+	case target == "anon_inode:[fanotify]":
+		f.Severity = SeverityWarning
+		f.Reason = "fanotify marks may not be restorable"
+	case target == "anon_inode:inotify":
+		if !a.configuration.DisableInotifyDetection {
+			// Watches are analyzed separately, see analyzeInotifyWatches.
+			return
+		}
+		f.Severity = SeverityWarning
+		f.Reason = "inotify watches on overlay filesystems may not be restorable"
+		f.Suggestion = "add the watched paths to inotifyIncompatiblePaths if the dump fails"
+	case strings.HasPrefix(target, "socket:"):
+		inode, _ := socketInode(target)
+		s, ok := a.unixSockets[inode]
+		if !ok || s.Peer == 0 || a.treeSockets[s.Peer] {
+			return
+		}
+		peer, ok := a.unixSockets[s.Peer]
+		if ok && slices.ContainsFunc(a.configuration.ExternalUnixSockets, func(e ExternalUnixSocket) bool { return e.Path == peer.Name }) {
+			return
+		}
+		f.Severity = SeverityError
+		f.Reason = "connected to a Unix socket outside of the process tree"
+		f.Suggestion = "close the connection before checkpoint, e.g. when notified with the checkpointing event"
+		if ok && peer.Name != "" {
+			f.Reason += fmt.Sprintf(" bound to %s", peer.Name)
+			f.Suggestion = fmt.Sprintf("add %s to externalUnixSockets or close the connection before checkpoint", peer.Name)
+		}
+	case strings.HasPrefix(target, "/dev/pts/") || target == "/dev/ptmx":
+		if a.configuration.TTY {
+			// The terminal of crik is dumped as external and other pty pairs in the tree are dumped by criu.
+			return
+		}
+		f.Severity = SeverityError
+		f.Reason = "terminals are supported only in TTY mode"
+		f.Suggestion = "set tty to true in the configuration"
+	case strings.HasPrefix(target, "/dev/") && !strings.HasPrefix(target, "/dev/shm/"):
+		if isUnderExternalMount(target, a.externals) {
+			return
+		}
+		f.Severity = SeverityError
+		f.Reason = "device is not marked as an external mount"
+		f.Suggestion = fmt.Sprintf("add %s to externalMounts or mount it in the container", target)
+	case strings.HasSuffix(target, " (deleted)"):
+		st, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid), "fd", strconv.Itoa(fd)))
+		if err != nil || st.Size() <= GhostLimit {
+			return
+		}
+		f.Severity = SeverityError
+		f.Reason = fmt.Sprintf("deleted file of %d MiB exceeds the ghost file limit of %d MiB", st.Size()>>20, GhostLimit>>20)
+		f.Suggestion = "close the file before checkpoint"
+	default:
+		return
+	}
+	a.add(f)
+}
+
+func (a *analyzer) analyzeMappings(pid int) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	seen := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Format: address perms offset dev inode pathname
+		fields := strings.SplitN(s.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.TrimSpace(fields[5])
+		if path == "" || strings.HasPrefix(path, "[") {
+			continue
+		}
+		a.analysis.Mappings++
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		finding := Finding{PID: pid, Resource: "mapping " + fields[0], Target: path}
+		switch {
+		case strings.HasPrefix(path, "/dev/shm/"):
+			if !a.configuration.DisableShmCapture {
+				continue
+			}
+			finding.Severity = SeverityWarning
+			finding.Reason = "/dev/shm is local to the pod and its contents are lost with it"
+			finding.Suggestion = "enable capturing /dev/shm by unsetting disableShmCapture"
+		case strings.HasPrefix(path, "/dev/") && !strings.HasPrefix(path, "/dev/zero"):
+			finding.Severity = SeverityError
+			finding.Reason = "criu cannot dump mappings of devices"
+		default:
+			continue
+		}
+		a.add(finding)
+	}
+}
+
+func readFds(pid int) map[int]string {
+	result := map[int]string{}
+	dir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return result
+	}
+	for _, e := range entries {
+		n, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		result[n] = target
+	}
+	return result
+}
+
+func socketInode(target string) (uint32, bool) {
+	v, ok := strings.CutPrefix(target, "socket:[")
+	if !ok {
+		return 0, false
+	}
+	inode, err := strconv.ParseUint(strings.TrimSuffix(v, "]"), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(inode), true
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+)
+
+const (
+	// legacyKubePodsDir is where the cgroup files were expected by checkpoints that do not record their cgroups.
+	legacyKubePodsDir = "/sys/fs/cgroup/kubepods.slice"
+)
+
+// CgroupDirs returns the directories of the cgroups of the given process in the filesystem of crik keyed by the
+// controllers of their hierarchy as they appear in /proc/<pid>/cgroup, e.g. "memory" and "cpu,cpuacct" for cgroup v1
+// and "" for cgroup v2. The paths differ between container runtimes and cgroup drivers, e.g. kubepods.slice/...scope
+// with systemd and kubepods/<pod>/<container> with cgroupfs, or are the root of the mount in a cgroup namespace.
+// Hierarchies that are not mounted in the container are left out.
+func CgroupDirs(pid int) (map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroups of %d: %w", pid, err)
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		// Format: hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		controllers, cgroupPath := parts[1], parts[2]
+		for _, m := range mounts {
+			if !cgroupMountMatches(m, controllers) {
+				continue
+			}
+			// The root of the mount is the cgroup that is mounted, relative to the root of the cgroup namespace.
+			rel, err := filepath.Rel(m.Root, cgroupPath)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			result[controllers] = filepath.Join(m.MountPoint, rel)
+			break
+		}
+	}
+	return result, nil
+}
+
+// cgroupMountMatches returns true if the given mount is the hierarchy with the given controllers.
+func cgroupMountMatches(m mountInfo, controllers string) bool {
+	if controllers == "" {
+		return m.FSType == "cgroup2"
+	}
+	if m.FSType != "cgroup" {
+		return false
+	}
+	opts := strings.Split(m.SuperOptions, ",")
+	for _, c := range strings.Split(controllers, ",") {
+		if !slices.Contains(opts, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// cgroupRemapper maps the paths in the cgroups of the checkpointed container to the same paths in the cgroups of the
+// new container.
+type cgroupRemapper struct {
+	old map[string]string
+	new map[string]string
+}
+
+// newCgroupRemapper returns a remapper from the given cgroups recorded during dump to the ones of crik.
+func newCgroupRemapper(old map[string]string) (cgroupRemapper, error) {
+	current, err := CgroupDirs(os.Getpid())
+	if err != nil {
+		return cgroupRemapper{}, err
+	}
+	return cgroupRemapper{old: old, new: current}, nil
+}
+
+// remap returns the path in the new container and true if the given path is in one of the old cgroups.
+func (r cgroupRemapper) remap(p string) (string, bool) {
+	if r.old == nil {
+		// Checkpoints taken by older versions of crik only had the files of the container's cgroup v2 directory.
+		newDir, ok := r.new[""]
+		if !ok || !isUnder(p, legacyKubePodsDir) {
+			return "", false
+		}
+		return filepath.Join(newDir, filepath.Base(p)), true
+	}
+	var controllers, oldDir string
+	for c, dir := range r.old {
+		// Nested cgroups may be mounted, so the most specific one wins.
+		if isUnder(p, dir) && len(dir) > len(oldDir) {
+			controllers, oldDir = c, dir
+		}
+	}
+	newDir, ok := r.new[controllers]
+	if oldDir == "" || !ok {
+		return "", false
+	}
+	return newDir + strings.TrimPrefix(p, oldDir), true
+}
+
+// CgroupInheritedFiles opens the cgroup files and directories the checkpointed process tree has open in the cgroups
+// of the new container, e.g. memory.max read by the JVM and Go runtimes, since the paths in the checkpoint contain the
+// IDs of the old pod and container. The returned keys are the ones criu expects in --inherit-fd for the files.
+func CgroupInheritedFiles(imageDir string, old map[string]string) ([]string, []*os.File, error) {
+	r, err := newCgroupRemapper(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := decodeFileEntries(filepath.Join(imageDir, "files.img"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys []string
+	var files []*os.File
+	seen := map[string]bool{}
+	for _, fe := range entries {
+		reg := fe.GetReg()
+		if reg == nil || seen[reg.GetName()] {
+			continue
+		}
+		p, ok := r.remap(reg.GetName())
+		if !ok {
+			continue
+		}
+		seen[reg.GetName()] = true
+		// Directories are opened read-only, which the access mode of their file descriptors always is.
+		flags := int(reg.GetFlags()) & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR | os.O_APPEND)
+		f, err := os.OpenFile(p, flags, 0)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to open %s in place of %s: %w", p, reg.GetName(), err)
+		}
+		keys = append(keys, strings.TrimPrefix(reg.GetName(), "/"))
+		files = append(files, f)
+	}
+	return keys, files, nil
+}
+
+// RemapCgroupWatches rewrites the paths of the inotify watches on cgroup files in the checkpoint, e.g. the ones on
+// cgroup.events, to the paths in the cgroups of the new container. The paths are recorded only when the dump is taken
+// with irmap forced, see HasCgroupWatches. The original image is kept next to the modified one so that the paths are
+// always rewritten from the ones of the dumped container if the restore is retried.
+func RemapCgroupWatches(imageDir string, old map[string]string) error {
+	r, err := newCgroupRemapper(old)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(imageDir, "files.img")
+	orig := path + ".orig"
+	src := path
+	if _, err := os.Stat(orig); err == nil {
+		src = orig
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	img, err := crit.New(in, nil, "", false, false).Decode(&fdinfo.FileEntry{})
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", src, err)
+	}
+	changed := false
+	for _, e := range img.Entries {
+		fe, ok := e.Message.(*fdinfo.FileEntry)
+		if !ok {
+			return fmt.Errorf("unexpected entry type %T", e.Message)
+		}
+		for _, wd := range fe.GetIfy().GetWd() {
+			p := wd.GetFHandle().GetPath()
+			if p == "" {
+				continue
+			}
+			n, ok := r.remap("/" + strings.TrimPrefix(p, "/"))
+			if !ok {
+				continue
+			}
+			if !strings.HasPrefix(p, "/") {
+				n = strings.TrimPrefix(n, "/")
+			}
+			wd.FHandle.Path = &n
+			changed = true
+		}
+	}
+	if !changed && src == path {
+		return nil
+	}
+	if src == path {
+		if err := os.Link(path, orig); err != nil {
+			return fmt.Errorf("failed to keep original image: %w", err)
+		}
+	}
+	return writeImage(path, img)
+}
+
+// HasCgroupWatches returns true if any of the given processes watches a file on a cgroup filesystem with inotify.
+// criu records such watches with file handles that cannot be opened in another container unless irmap is forced.
+func HasCgroupWatches(pids []int) (bool, error) {
+	watches, err := ListInotifyWatches(pids)
+	if err != nil || len(watches) == 0 {
+		return false, err
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.FSType != "cgroup" && m.FSType != "cgroup2" {
+			continue
+		}
+		for _, w := range watches {
+			if w.Major == m.Major && w.Minor == m.Minor {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func decodeFileEntries(path string) ([]*fdinfo.FileEntry, error) {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	img, err := crit.New(in, nil, "", false, false).Decode(&fdinfo.FileEntry{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	var result []*fdinfo.FileEntry
+	for _, e := range img.Entries {
+		if fe, ok := e.Message.(*fdinfo.FileEntry); ok {
+			result = append(result, fe)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MinCriuVersion is the oldest criu version crik works with. 3.17 is the first version with unprivileged mode.
+	MinCriuVersion = 31700
+	// MinCriuVersionNetworkLock is the oldest criu version crik works with when networkLock is set. 3.19 is the
+	// first version with "skip" network lock method.
+	MinCriuVersionNetworkLock = 31900
+)
+
+// CheckResult is the result of a single preflight check.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// CheckOptions configures the preflight checks.
+type CheckOptions struct {
+	// MinFreeBytes is the minimum free space required in the image directory.
+	MinFreeBytes uint64
+}
+
+// RunChecks verifies that the node and the container are ready to checkpoint and restore with the given
+// configuration.
+func RunChecks(cfg Configuration, opts CheckOptions) []CheckResult {
+	results := []CheckResult{checkCriuBinary()}
+	if results[0].Passed {
+		results = append(results, checkCriuVersion(cfg), checkKernelFeatures())
+	}
+	return append(results,
+		checkImageDir(cfg.ImageDir),
+		checkFreeSpace(cfg.ImageDir, opts.MinFreeBytes),
+		checkLastPID(cfg),
+		checkTimeNamespace(cfg),
+		checkCgroupVersion(),
+		checkCapabilities(cfg),
+	)
+}
+
+// ChecksPassed returns true if all checks passed.
+func ChecksPassed(results []CheckResult) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// PrintChecks writes a human-readable report of the results.
+func PrintChecks(w io.Writer, results []CheckResult) {
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, r.Name, r.Message)
+	}
+}
+
+func checkCriuBinary() CheckResult {
+	r := CheckResult{Name: "criu binary"}
+	p, err := exec.LookPath("criu")
+	if err != nil {
+		r.Message = fmt.Sprintf("criu is not found in PATH: %s", err.Error())
+		return r
+	}
+	r.Passed = true
+	r.Message = p
+	return r
+}
+
+func checkCriuVersion(cfg Configuration) CheckResult {
+	r := CheckResult{Name: "criu version"}
+	v, err := criu.MakeCriu().GetCriuVersion()
+	if err != nil {
+		r.Message = fmt.Sprintf("failed to get criu version: %s", err.Error())
+		return r
+	}
+	r.Message = formatCriuVersion(v)
+	minVersion := requiredCriuVersion(cfg)
+	if v < minVersion {
+		r.Message += fmt.Sprintf(", at least %s is required", formatCriuVersion(minVersion))
+		if minVersion != MinCriuVersion {
+			r.Message += " by networkLock"
+		}
+		return r
+	}
+	r.Passed = true
+	return r
+}
+
+// requiredCriuVersion returns the oldest criu version that supports the given configuration.
+func requiredCriuVersion(cfg Configuration) int {
+	if cfg.NetworkLock != NetworkLockMethodNone {
+		return MinCriuVersionNetworkLock
+	}
+	return MinCriuVersion
+}
+
+// formatCriuVersion formats a version number as reported by criu, e.g. 31900, as major.minor.sublevel, omitting the
+// sublevel if it's zero.
+func formatCriuVersion(v int) string {
+	if v%100 == 0 {
+		return fmt.Sprintf("%d.%d", v/10000, v/100%100)
+	}
+	return fmt.Sprintf("%d.%d.%d", v/10000, v/100%100, v%100)
+}
+
+func checkKernelFeatures() CheckResult {
+	r := CheckResult{Name: "kernel features"}
+	out, err := exec.Command("criu", "check").CombinedOutput()
+	msg := strings.TrimSpace(string(out))
+	if err != nil {
+		r.Message = fmt.Sprintf("criu check failed: %s", msg)
+		return r
+	}
+	r.Passed = true
+	r.Message = msg
+	return r
+}
+
+func checkImageDir(imageDir string) CheckResult {
+	r := CheckResult{Name: "image directory"}
+	if imageDir == "" {
+		r.Passed = true
+		r.Message = "imageDir is not configured, checkpoints will not be taken"
+		return r
+	}
+	// The directory is created at checkpoint time, so the check probes the closest existing ancestor instead of
+	// creating it.
+	dir := existingAncestor(imageDir)
+	f, err := os.CreateTemp(dir, ".crik-check-")
+	if err != nil {
+		r.Message = fmt.Sprintf("%s is not writable: %s", dir, err.Error())
+		return r
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+	r.Passed = true
+	r.Message = fmt.Sprintf("%s is writable", imageDir)
+	if dir != filepath.Clean(imageDir) {
+		r.Message = fmt.Sprintf("%s does not exist yet, %s is writable", imageDir, dir)
+	}
+	return r
+}
+
+// existingAncestor returns the given path if it exists, or its closest ancestor that does.
+func existingAncestor(p string) string {
+	p = filepath.Clean(p)
+	for p != filepath.Dir(p) {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			break
+		}
+		p = filepath.Dir(p)
+	}
+	return p
+}
+
+func checkFreeSpace(imageDir string, minFree uint64) CheckResult {
+	r := CheckResult{Name: "free disk space"}
+	if imageDir == "" {
+		r.Passed = true
+		r.Message = "imageDir is not configured"
+		return r
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(existingAncestor(imageDir), &st); err != nil {
+		r.Message = fmt.Sprintf("failed to stat filesystem of %s: %s", imageDir, err.Error())
+		return r
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	r.Message = fmt.Sprintf("%d MiB available in %s", free/(1<<20), imageDir)
+	if free < minFree {
+		r.Message += fmt.Sprintf(", at least %d MiB is required", minFree/(1<<20))
+		return r
+	}
+	r.Passed = true
+	return r
+}
+
+func checkLastPID(cfg Configuration) CheckResult {
+	r := CheckResult{Name: "ns_last_pid"}
+	switch {
+	case HasNamespace(NamespacesOrDefault(cfg.Namespaces), NamespacePID):
+		r.Passed = true
+		r.Message = "not needed since pid namespace is used"
+	case IsLastPIDWritable():
+		r.Passed = true
+		r.Message = fmt.Sprintf("%s is writable", LastPIDPath)
+	case SupportsSetTID():
+		r.Passed = true
+		r.Message = "not needed since the kernel supports clone3 with set_tid"
+	default:
+		r.Message = fmt.Sprintf("%s is not writable and the kernel is older than 5.5", LastPIDPath)
+	}
+	return r
+}
+
+func checkTimeNamespace(cfg Configuration) CheckResult {
+	r := CheckResult{Name: "time namespace", Passed: true}
+	switch {
+	case !HasNamespace(NamespacesOrDefault(cfg.Namespaces), NamespaceTime):
+		r.Message = "not needed since time namespace is not used"
+	case KernelAtLeast(5, 17):
+		r.Message = "supported by the kernel"
+	default:
+		r.Passed = false
+		r.Message = "Linux 5.17+ is required for the wrapped process to enter the time namespace"
+	}
+	return r
+}
+
+func checkCgroupVersion() CheckResult {
+	r := CheckResult{Name: "cgroup version", Passed: true}
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		r.Message = "v2"
+	} else {
+		r.Message = "v1"
+	}
+	return r
+}
+
+func checkCapabilities(cfg Configuration) CheckResult {
+	r := CheckResult{Name: "capabilities"}
+	if err := CheckPrivileges(cfg); err != nil {
+		r.Message = strings.NewReplacer(":\n  - ", ": ", "\n  - ", ", ").Replace(err.Error())
+		return r
+	}
+	r.Passed = true
+	r.Message = "all required capabilities are available"
+	if InUserNamespace() {
+		r.Message += " in the user namespace of the pod"
+	}
+	if IsUnprivileged() {
+		r.Message += ", criu will run in unprivileged mode"
+	}
+	return r
+}
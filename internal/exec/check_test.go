@@ -0,0 +1,92 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatCriuVersion(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{version: 31700, want: "3.17"},
+		{version: 31901, want: "3.19.1"},
+		{version: 40000, want: "4.0"},
+		{version: 40112, want: "4.1.12"},
+	}
+	for _, tt := range tests {
+		if got := formatCriuVersion(tt.version); got != tt.want {
+			t.Errorf("formatCriuVersion(%d) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredCriuVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Configuration
+		want int
+	}{
+		{name: "default", cfg: Configuration{}, want: MinCriuVersion},
+		{name: "nftables", cfg: Configuration{NetworkLock: NetworkLockMethodNFTables}, want: MinCriuVersionNetworkLock},
+		{name: "iptables", cfg: Configuration{NetworkLock: NetworkLockMethodIPTables}, want: MinCriuVersionNetworkLock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requiredCriuVersion(tt.cfg); got != tt.want {
+				t.Errorf("requiredCriuVersion() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistingAncestor(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: dir, want: dir},
+		{path: filepath.Join(dir, "a"), want: filepath.Join(dir, "a")},
+		{path: filepath.Join(dir, "a", "b", "c"), want: filepath.Join(dir, "a")},
+		{path: filepath.Join(dir, "x") + "/", want: dir},
+		{path: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := existingAncestor(tt.path); got != tt.want {
+			t.Errorf("existingAncestor(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckImageDirDoesNotCreateIt(t *testing.T) {
+	imageDir := filepath.Join(t.TempDir(), "images")
+	r := checkImageDir(imageDir)
+	if !r.Passed {
+		t.Fatalf("checkImageDir() failed: %s", r.Message)
+	}
+	if _, err := os.Stat(imageDir); !os.IsNotExist(err) {
+		t.Errorf("checkImageDir() created %s", imageDir)
+	}
+}
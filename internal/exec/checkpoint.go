@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"slices"
 	"strconv"
 	"syscall"
 	"time"
@@ -28,23 +29,51 @@ import (
 	"github.com/checkpoint-restore/go-criu/v7"
 	"github.com/checkpoint-restore/go-criu/v7/rpc"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/qawolf/crik/pkg/notify"
+)
+
+const (
+	// InotifyStashDirName is the directory in the image directory where inotify incompatible paths are kept while
+	// they are deleted from their original location.
+	InotifyStashDirName = "inotifyPaths"
+
+	// GhostLimit is the maximum size of a deleted but open file that criu includes in the checkpoint.
+	GhostLimit = 500 * 1048576 // 500MB
 )
 
 type Actions struct {
 	pid           int
 	configuration Configuration
+
+	// externalMounts is the list of mounts marked as external, which is recorded for restore.
+	externalMounts []DirectoryMount
+
+	// externalConnections is the list of sockets connected to external Unix sockets, which is recorded for restore.
+	externalConnections []externalUnixConnection
+
+	// inotifyPaths is the list of paths that criu reported as incompatible in the previous attempt.
+	inotifyPaths []string
 }
 
 // PreDump is called when criu is about to dump the process.
 func (a Actions) PreDump() error {
-	// Temp hack to resolve crash during dump.
-	for _, p := range a.configuration.InotifyIncompatiblePaths {
-		if err := os.RemoveAll(p); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", p, err)
+	// Temp hack to resolve crash during dump. The paths have to be deleted so that the watched inodes are released,
+	// so we keep a copy to put them back after the dump and in the new container.
+	paths, err := a.inotifyIncompatiblePaths()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := stashPath(p, filepath.Join(a.configuration.ImageDir, InotifyStashDirName)); err != nil {
+			return fmt.Errorf("failed to stash %s: %w", p, err)
 		}
 	}
 	conf := &configurationOnDisk{
-		Configuration: a.configuration,
+		Configuration:           a.configuration,
+		DumpedExternalMounts:    a.externalMounts,
+		ExternalUnixConnections: a.externalConnections,
+		InheritedFdKeys:         readInheritedFds(a.pid, a.configuration.InheritedFds),
 	}
 	conf.UnixFileDescriptorTrio = make([]string, 3)
 	fdDir := filepath.Join("/proc", strconv.Itoa(a.pid), "fd")
@@ -56,29 +85,165 @@ func (a Actions) PreDump() error {
 		}
 		conf.UnixFileDescriptorTrio[i] = link
 	}
-	confYAML, err := yaml.Marshal(conf)
-	if err != nil {
-		return fmt.Errorf("failed to marshal fds: %w", err)
+	if a.configuration.NetworkLock != NetworkLockMethodNone {
+		if conf.PodIPs, err = podIPs(); err != nil {
+			return err
+		}
+	}
+	if a.configuration.TTY {
+		if conf.TTYState, err = readTTYState(a.pid); err != nil {
+			return err
+		}
 	}
-	if err := os.WriteFile(filepath.Join(a.configuration.ImageDir, ConfigurationFileName), confYAML, 0o600); err != nil {
-		return fmt.Errorf("failed to write stdio-fds.json: %w", err)
+	if a.configuration.Notification != nil {
+		conf.Generation = a.configuration.Notification.CurrentGeneration() + 1
 	}
-	if err := os.MkdirAll(filepath.Join(a.configuration.ImageDir, "extraFiles"), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(a.configuration.ImageDir, ExtraFilesDirName), 0755); err != nil {
 		return fmt.Errorf("failed to create extra path: %w", err)
 	}
-	for _, p := range a.configuration.AdditionalPaths {
-		if _, err := os.Stat(p); os.IsNotExist(err) {
-			continue
+	// Only the files changed since the paths were pre-staged, if they were, are copied.
+	if err := SyncAdditionalPaths(a.configuration); err != nil {
+		return err
+	}
+	if conf.CgroupDirs, err = CgroupDirs(a.pid); err != nil {
+		return err
+	}
+	// Images of the previous checkpoint modified during restore must not be used for the new one, see
+	// AdvanceTimeNamespaces and RemapCgroupWatches.
+	origs, err := filepath.Glob(filepath.Join(a.configuration.ImageDir, "*.img.orig"))
+	if err != nil {
+		return fmt.Errorf("failed to find original time namespace images: %w", err)
+	}
+	for _, p := range origs {
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p, err)
 		}
-		if err := CopyDir(p, filepath.Join(a.configuration.ImageDir, "extraFiles", p)); err != nil {
-			return fmt.Errorf("failed to copy %s: %w", p, err)
+	}
+	// The process tree is frozen right after this hook returns.
+	now := time.Now()
+	conf.CheckpointTime = &now
+	return writeConfigurationOnDisk(a.configuration.ImageDir, conf)
+}
+
+// writeConfigurationOnDisk writes the configuration with the metadata of the checkpoint into the image directory.
+func writeConfigurationOnDisk(imageDir string, conf *configurationOnDisk) error {
+	confYAML, err := yaml.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, ConfigurationFileName), confYAML, 0o600); err != nil {
+		return fmt.Errorf("failed to write configuration: %w", err)
+	}
+	return nil
+}
+
+// inotifyIncompatiblePaths returns the configured paths together with the ones detected from the inotify watches of
+// the process tree and the ones reported by criu in the previous attempt.
+func (a Actions) inotifyIncompatiblePaths() ([]string, error) {
+	paths := append(slices.Clone(a.configuration.InotifyIncompatiblePaths), a.inotifyPaths...)
+	if !a.configuration.DisableInotifyDetection {
+		pids, err := ProcessTree(a.pid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list process tree: %w", err)
+		}
+		detected, err := DetectInotifyIncompatiblePaths(pids)
+		if err != nil {
+			// The paths criu fails to open are reported in its log and retried, see TakeCheckpoint.
+			fmt.Printf("failed to detect inotify incompatible paths: %s\n", err.Error())
 		}
+		paths = append(paths, detected...)
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
+
+// resetForRetry brings the filesystem and the network back to the state they were in before the failed dump so that
+// PreDump of the retry sees the stashed paths instead of recording them as deleted, and stashes them again together
+// with the ones criu reported.
+func (a Actions) resetForRetry() error {
+	if err := UnstashPaths(a.configuration.ImageDir); err != nil {
+		return fmt.Errorf("failed to put back inotify incompatible paths: %w", err)
+	}
+	if err := os.RemoveAll(filepath.Join(a.configuration.ImageDir, InotifyStashDirName)); err != nil {
+		return fmt.Errorf("failed to clean up stashed inotify paths: %w", err)
+	}
+	if err := a.NetworkUnlock(); err != nil {
+		return fmt.Errorf("failed to unlock network: %w", err)
+	}
+	if err := a.NetworkLock(); err != nil {
+		return fmt.Errorf("failed to lock network: %w", err)
 	}
 	return nil
 }
 
-// PostDump does nothing.
+// stashPath copies the path into the stash directory and deletes the original.
+func stashPath(p, stashDir string) error {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return nil
+	}
+	if err := CopyDir(p, filepath.Join(stashDir, p)); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// UnstashPaths copies the stashed paths back to their original locations.
+func UnstashPaths(imageDir string) error {
+	stashDir := filepath.Join(imageDir, InotifyStashDirName)
+	if _, err := os.Stat(stashDir); os.IsNotExist(err) {
+		return nil
+	}
+	return CopyDir(stashDir, "/")
+}
+
+// PostDump records the parent directories of the Unix sockets and copies the changes of the root filesystem, the
+// contents of the emptyDir volumes and the files that the process tree has open or mapped and that are not part of the
+// container's image into the checkpoint.
 func (a Actions) PostDump() error {
+	conf, err := readConfigurationOnDisk(a.configuration.ImageDir)
+	if err != nil {
+		return err
+	}
+	if conf.SocketDirs, err = RecordSocketDirs(a.configuration.ImageDir); err != nil {
+		return fmt.Errorf("failed to record parent directories of Unix sockets: %w", err)
+	}
+	// The process tree is frozen, so the files match the sizes and modes criu recorded.
+	if a.configuration.RootfsDiff {
+		// The inotify incompatible paths are not needed to be deleted anymore, and they have to be in place so that
+		// the diff doesn't record them as deleted.
+		if err := UnstashPaths(a.configuration.ImageDir); err != nil {
+			return fmt.Errorf("failed to put back inotify incompatible paths: %w", err)
+		}
+		if err := WriteRootfsDiff(a.configuration.ImageDir); err != nil {
+			return fmt.Errorf("failed to capture rootfs diff: %w", err)
+		}
+	} else if err := os.RemoveAll(filepath.Join(a.configuration.ImageDir, RootfsDiffFileName)); err != nil {
+		return fmt.Errorf("failed to remove rootfs diff of the previous checkpoint: %w", err)
+	}
+	if conf.EmptyDirSnapshots, err = SnapshotEmptyDirs(a.configuration, a.pid); err != nil {
+		return fmt.Errorf("failed to copy emptyDir volumes: %w", err)
+	}
+	if err := writeConfigurationOnDisk(a.configuration.ImageDir, conf); err != nil {
+		return err
+	}
+	var paths []string
+	if !a.configuration.DisableFileDiscovery {
+		if paths, err = DiscoverModifiedFiles(a.configuration.ImageDir); err != nil {
+			return fmt.Errorf("failed to discover modified files: %w", err)
+		}
+		for _, p := range paths {
+			if err := CopyDir(p, filepath.Join(a.configuration.ImageDir, ExtraFilesDirName, p)); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", p, err)
+			}
+		}
+		if len(paths) > 0 {
+			fmt.Printf("Included %d files created or modified after the container started: %v\n", len(paths), paths)
+		}
+	}
+	// The image directory may be reused, so the files discovered in earlier checkpoints are removed.
+	if err := pruneExtraFiles(a.configuration, paths); err != nil {
+		return fmt.Errorf("failed to remove files of earlier checkpoints: %w", err)
+	}
 	return nil
 }
 
@@ -92,14 +257,22 @@ func (a Actions) PostRestore(pid int32) error {
 	return nil
 }
 
-// NetworkLock does nothing.
+// NetworkLock blocks the traffic of the pod if a network lock method is configured.
 func (a Actions) NetworkLock() error {
-	return nil
+	l, err := NewNetworkLocker(a.configuration.NetworkLock)
+	if err != nil {
+		return err
+	}
+	return l.Lock()
 }
 
-// NetworkUnlock does nothing.
+// NetworkUnlock releases the lock taken by NetworkLock.
 func (a Actions) NetworkUnlock() error {
-	return nil
+	l, err := NewNetworkLocker(a.configuration.NetworkLock)
+	if err != nil {
+		return err
+	}
+	return l.Unlock()
 }
 
 // SetupNamespaces does nothing.
@@ -123,6 +296,14 @@ func TakeCheckpoint(c *criu.Criu, pid int, configuration Configuration) (time.Du
 	if err != nil {
 		return time.Since(start), fmt.Errorf("failed to open directory %s: %w", configuration.ImageDir, err)
 	}
+	mounts, err := ExternalMounts(configuration)
+	if err != nil {
+		return time.Since(start), fmt.Errorf("failed to find external mounts: %w", err)
+	}
+	conns, err := ExternalUnixConnections(pid, configuration.ExternalUnixSockets)
+	if err != nil {
+		return time.Since(start), fmt.Errorf("failed to find connections to external Unix sockets: %w", err)
+	}
 	cgMode := rpc.CriuCgMode_IGNORE
 	opts := &rpc.CriuOpts{
 		TcpEstablished:    proto.Bool(true),
@@ -138,17 +319,86 @@ func TakeCheckpoint(c *criu.Criu, pid int, configuration Configuration) (time.Du
 		LeaveStopped:      proto.Bool(false),
 		LogLevel:          proto.Int32(4),
 		LazyPages:         proto.Bool(false),
-		GhostLimit:        proto.Uint32(500 * 1048576), // 500MB
+		GhostLimit:        proto.Uint32(GhostLimit),
 		Root:              proto.String("/"),
 		TcpClose:          proto.Bool(true),
 		ManageCgroupsMode: &cgMode,
-		External:          GetExternalDirectoriesForCheckpoint(),
+		Unprivileged:      proto.Bool(IsUnprivileged()),
+		External:          append(GetExternalDirectoriesForCheckpoint(mounts), GetExternalUnixSocketsForCheckpoint(conns)...),
+	}
+	if len(conns) > 0 {
+		opts.ExtUnixSk = proto.Bool(true)
+	}
+	if configuration.TTY {
+		// The slave end of the pty of crik is external to the process tree and given to criu during restore.
+		key, err := TTYKey(pid)
+		if err != nil {
+			return time.Since(start), err
+		}
+		opts.ShellJob = proto.Bool(true)
+		opts.External = append(opts.External, key)
+	}
+	if pids, err := ProcessTree(pid); err == nil {
+		if watched, err := HasCgroupWatches(pids); err == nil && watched {
+			// Watches on cgroup files, e.g. cgroup.events, are restored with their paths, which are remapped to the
+			// cgroups of the new container during restore.
+			opts.ForceIrmap = proto.Bool(true)
+		}
 	}
 	actions := Actions{
-		pid:           pid,
-		configuration: configuration,
+		pid:                 pid,
+		configuration:       configuration,
+		externalMounts:      mounts,
+		externalConnections: conns,
+	}
+	if configuration.NetworkLock != NetworkLockMethodNone {
+		// criu calls the network lock callbacks only when it dumps the network namespace, which we don't, so we
+		// lock the whole pod ourselves and let criu skip locking the individual connections.
+		opts.TcpClose = proto.Bool(false)
+		opts.NetworkLock = rpc.CriuNetworkLockMethod_SKIP.Enum()
 	}
-	if err := c.Dump(opts, actions); err != nil {
+	n := configuration.Notification
+	if n != nil {
+		if err := n.Notify(pid, notify.EventCheckpointing, n.CurrentGeneration()); err != nil {
+			return time.Since(start), fmt.Errorf("failed to announce checkpoint: %w", err)
+		}
+		time.Sleep(time.Duration(n.PreCheckpointDelaySeconds) * time.Second)
+	}
+	if err := os.RemoveAll(filepath.Join(configuration.ImageDir, InotifyStashDirName)); err != nil {
+		return time.Since(start), fmt.Errorf("failed to clean up stashed inotify paths: %w", err)
+	}
+	if err := actions.NetworkLock(); err != nil {
+		return time.Since(start), fmt.Errorf("failed to lock network: %w", err)
+	}
+	err = c.Dump(opts, actions)
+	if err != nil && !configuration.DisableInotifyDetection {
+		// Watches whose targets could not be resolved before the dump are reported by criu, so we retry once with
+		// the reported paths.
+		paths, pErr := ParseInotifyFailures(filepath.Join(configuration.ImageDir, "dump.log"))
+		if pErr == nil && len(paths) > 0 {
+			fmt.Printf("Dump failed due to inotify watches on %v, retrying.\n", paths)
+			actions.inotifyPaths = paths
+			if rErr := actions.resetForRetry(); rErr != nil {
+				err = fmt.Errorf("failed to prepare retry: %w", rErr)
+			} else {
+				err = c.Dump(opts, actions)
+			}
+		}
+	}
+	// The paths are put back regardless of the result since the process may keep running, e.g. if the dump fails.
+	if uErr := UnstashPaths(configuration.ImageDir); uErr != nil {
+		fmt.Printf("failed to put back inotify incompatible paths: %s\n", uErr.Error())
+	}
+	if err != nil {
+		// criu resumes the process tree if the dump fails.
+		if uErr := actions.NetworkUnlock(); uErr != nil {
+			fmt.Printf("failed to unlock network: %s\n", uErr.Error())
+		}
+		if n != nil {
+			if nErr := n.Notify(pid, notify.EventCheckpointAborted, n.CurrentGeneration()); nErr != nil {
+				fmt.Printf("failed to announce aborted checkpoint: %s\n", nErr.Error())
+			}
+		}
 		return time.Since(start), fmt.Errorf("failed to dump: %w", err)
 	}
 	return time.Since(start), nil
@@ -0,0 +1,250 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ConflictPolicy decides what happens when a file included in the checkpoint already exists in the new container with
+// different contents, e.g. when the container is restored with a newer version of its image.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverwrite replaces the file in the new container with the one in the checkpoint. It is the
+	// default.
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+	// ConflictPolicyKeepExisting keeps the file in the new container.
+	ConflictPolicyKeepExisting ConflictPolicy = "keep-existing"
+	// ConflictPolicyFailOnDiff fails the restore. Files deleted in the checkpointed container that exist in the new
+	// one count as different.
+	ConflictPolicyFailOnDiff ConflictPolicy = "fail-on-diff"
+)
+
+// PathConflictPolicy is the conflict policy of the files matching a path.
+type PathConflictPolicy struct {
+	// Path is a file, a directory that contains the files or a glob pattern as in AdditionalPath.
+	Path string `json:"path"`
+
+	// Policy is either "overwrite", "keep-existing" or "fail-on-diff".
+	Policy ConflictPolicy `json:"policy"`
+}
+
+// ConflictReport lists the files of the checkpoint that differ from the ones in the new container.
+type ConflictReport struct {
+	// Replaced is the list of files overwritten with the ones in the checkpoint.
+	Replaced []string
+	// Kept is the list of files kept as they are in the new container.
+	Kept []string
+	// Removed is the list of files removed since they were deleted in the checkpointed container.
+	Removed []string
+}
+
+// Print writes a human-readable summary of the report.
+func (r ConflictReport) Print(w io.Writer) {
+	for _, p := range r.Replaced {
+		fmt.Fprintf(w, "Replaced %s with the file in the checkpoint.\n", p)
+	}
+	for _, p := range r.Kept {
+		fmt.Fprintf(w, "Kept %s of the new container instead of the file in the checkpoint.\n", p)
+	}
+	for _, p := range r.Removed {
+		fmt.Fprintf(w, "Removed %s since it was deleted in the checkpoint.\n", p)
+	}
+}
+
+// conflictPolicyFor returns the policy of the given path, which is the one of the first matching entry in
+// ConflictPolicies or ConflictPolicy if none matches.
+func (c Configuration) conflictPolicyFor(p string) ConflictPolicy {
+	for _, r := range c.ConflictPolicies {
+		if isUnder(p, filepath.Clean(r.Path)) || matchGlob(r.Path, p) {
+			return r.Policy
+		}
+	}
+	if c.ConflictPolicy == "" {
+		return ConflictPolicyOverwrite
+	}
+	return c.ConflictPolicy
+}
+
+// ReplayCheckpointFiles puts the files of the checkpoint back in the new container before restore: the rootfs diff,
+// the files that are not part of the container's image, the contents of emptyDir volumes and the stashed inotify
+// incompatible paths, in that order so that the files included explicitly take precedence. The conflict policies of the
+// given configuration are applied to the files that exist in the new container with different contents.
+func ReplayCheckpointFiles(imageDir string, cfg Configuration) (ConflictReport, error) {
+	r := &conflictResolver{cfg: cfg, written: map[string]bool{}}
+	if err := applyRootfsDiff(imageDir, r); err != nil {
+		return r.report, fmt.Errorf("failed to apply rootfs diff: %w", err)
+	}
+	conf, err := readConfigurationOnDisk(imageDir)
+	if err != nil {
+		return r.report, err
+	}
+	if err := r.replay(filepath.Join(imageDir, ExtraFilesDirName), "/"); err != nil {
+		return r.report, fmt.Errorf("failed to copy %s: %w", ExtraFilesDirName, err)
+	}
+	emptyDirs := filepath.Join(imageDir, EmptyDirsDirName)
+	if conf.EmptyDirSnapshots == nil {
+		// Checkpoints taken by older versions of crik.
+		if err := r.replay(emptyDirs, "/"); err != nil {
+			return r.report, fmt.Errorf("failed to copy %s: %w", EmptyDirsDirName, err)
+		}
+	}
+	for _, v := range conf.EmptyDirSnapshots {
+		if err := r.replay(filepath.Join(emptyDirs, v), v); err != nil {
+			return r.report, fmt.Errorf("failed to copy %s: %w", v, err)
+		}
+	}
+	if err := r.replay(filepath.Join(imageDir, InotifyStashDirName), "/"); err != nil {
+		return r.report, fmt.Errorf("failed to copy %s: %w", InotifyStashDirName, err)
+	}
+	return r.report, nil
+}
+
+// conflictResolver applies the conflict policies to the files of the checkpoint and records the outcome.
+type conflictResolver struct {
+	cfg    Configuration
+	report ConflictReport
+	// written is the set of paths already put back from the checkpoint, which later steps replace without a report.
+	written map[string]bool
+}
+
+// resolve returns whether the file at dst should be replaced with the one at src with the given stat.
+func (r *conflictResolver) resolve(src, dst string, st *unix.Stat_t) (bool, error) {
+	if r.written[dst] {
+		return true, nil
+	}
+	same, err := sameFile(src, dst, st)
+	if err != nil {
+		return false, fmt.Errorf("failed to compare %s: %w", dst, err)
+	}
+	if same {
+		// The metadata is still restored.
+		return true, nil
+	}
+	switch r.cfg.conflictPolicyFor(dst) {
+	case ConflictPolicyKeepExisting:
+		r.report.Kept = append(r.report.Kept, dst)
+		return false, nil
+	case ConflictPolicyFailOnDiff:
+		return false, fmt.Errorf("%s in the new container differs from the one in the checkpoint", dst)
+	default:
+		r.report.Replaced = append(r.report.Replaced, dst)
+		return true, nil
+	}
+}
+
+// resolveDeletion returns whether the given path, which was deleted in the checkpointed container, should be deleted
+// in the new container as well.
+func (r *conflictResolver) resolveDeletion(p string) (bool, error) {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return false, nil
+	}
+	switch r.cfg.conflictPolicyFor(p) {
+	case ConflictPolicyKeepExisting:
+		r.report.Kept = append(r.report.Kept, p)
+		return false, nil
+	case ConflictPolicyFailOnDiff:
+		return false, fmt.Errorf("%s exists in the new container but was deleted in the checkpoint", p)
+	default:
+		r.report.Removed = append(r.report.Removed, p)
+		return true, nil
+	}
+}
+
+// replay copies the given directory of the checkpoint onto the given directory of the root filesystem.
+func (r *conflictResolver) replay(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	return copyTree(src, dst, copyOptions{
+		workers:    1,
+		onConflict: r.resolve,
+		// Only the paths actually written are replaced by the later steps without applying the policies.
+		onWrite: func(dst string) {
+			r.written[dst] = true
+		},
+	})
+}
+
+// sameFile returns true if the file at dst has the same type and contents as the file at src with the given stat.
+func sameFile(src, dst string, st *unix.Stat_t) (bool, error) {
+	var dstSt unix.Stat_t
+	if err := unix.Lstat(dst, &dstSt); err != nil {
+		return false, err
+	}
+	if dstSt.Mode&unix.S_IFMT != st.Mode&unix.S_IFMT {
+		return false, nil
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		if dstSt.Size != st.Size {
+			return false, nil
+		}
+		return sameContents(src, dst)
+	case unix.S_IFLNK:
+		a, err := os.Readlink(src)
+		if err != nil {
+			return false, err
+		}
+		b, err := os.Readlink(dst)
+		if err != nil {
+			return false, err
+		}
+		return a == b, nil
+	case unix.S_IFDIR:
+		return true, nil
+	default:
+		return dstSt.Rdev == st.Rdev, nil
+	}
+}
+
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyDir copies the file or directory at src to dst preserving symlinks, special files, hardlinks within src, holes of
+// sparse files, ownership, permissions, timestamps and extended attributes. criu validates the size and mode of the
+// files the process tree has open, so the copies have to be faithful.
+// The missing parent directories of dst are created with the metadata of the corresponding parents of src. Existing
+// files at the destination are replaced while existing directories are merged.
+func CopyDir(src, dst string) error {
+	return copyTree(src, dst, copyOptions{workers: 1})
+}
+
+// copyOptions configures copyTree.
+type copyOptions struct {
+	// incremental skips the unchanged files and removes the ones missing in the source.
+	incremental bool
+	// workers is the number of regular files copied in parallel.
+	workers int
+	// include filters the files and directories to copy, all of them are copied if nil. The root is always copied.
+	include func(p string, isDir bool) bool
+	// onConflict is called when something other than a directory exists at the destination and returns whether it
+	// should be replaced. Everything is replaced if nil.
+	onConflict func(src, dst string, st *unix.Stat_t) (bool, error)
+	// onWrite is called with the destination of every entry that is copied, i.e. not left out by include or
+	// onConflict, before it's written.
+	onWrite func(dst string)
+}
+
+func copyTree(src, dst string, opts copyOptions) error {
+	c := &copier{copyOptions: opts, links: map[fileID]string{}}
+	if err := c.copyParents(src, dst); err != nil {
+		return err
+	}
+	_, rootErr := os.Lstat(dst)
+	dstRootExisted := rootErr == nil
+
+	jobs := make(chan fileJob)
+	errs := make(chan error, opts.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := j.run(); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	err := filepath.WalkDir(src, func(srcPath string, _ os.DirEntry, err error) error {
+		// If the file/folder doesn't exist, we don't need to copy it.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(errs) > 0 {
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(srcPath, &st); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+			return fmt.Errorf("failed to stat %s: %w", srcPath, err)
+		}
+		isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+		if rel != "." && c.include != nil && !c.include(srcPath, isDir) {
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dstPath := filepath.Join(dst, rel)
+		if rel == "." && dstRootExisted && !c.incremental && isDir {
+			// Directories like / are merged into, their metadata is left as is.
+			return nil
+		}
+		if c.onConflict != nil {
+			if fi, err := os.Lstat(dstPath); err == nil && !(isDir && isDirOrLinkToDir(dstPath, fi)) {
+				replace, err := c.onConflict(srcPath, dstPath, &st)
+				if err != nil {
+					return err
+				}
+				if !replace {
+					if isDir {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+		}
+		if c.onWrite != nil {
+			c.onWrite(dstPath)
+		}
+		return c.copyEntry(srcPath, dstPath, &st, jobs)
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	for _, l := range c.pendingLinks {
+		if err := c.link(l.first, l.dst); err != nil {
+			return fmt.Errorf("failed to link %s: %w", l.dst, err)
+		}
+	}
+	return c.finish()
+}
+
+// fileID identifies an inode.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileJob is a regular file to be copied by a worker.
+type fileJob struct {
+	src, dst string
+	st       unix.Stat_t
+}
+
+func (j fileJob) run() error {
+	if err := copyRegularFile(j.src, j.dst, j.st.Size); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", j.src, err)
+	}
+	return applyMetadata(j.src, j.dst, &j.st)
+}
+
+// pendingLink is a hardlink to be created once the file it points to is copied.
+type pendingLink struct {
+	first, dst string
+}
+
+// copier holds the state of a single copyTree call.
+type copier struct {
+	copyOptions
+
+	// links maps the inodes with multiple links to the first path they are copied to.
+	links map[fileID]string
+	// pendingLinks is the list of the other paths of those inodes.
+	pendingLinks []pendingLink
+	// dirs is the list of directories whose metadata is applied once their contents are copied, since creating files
+	// changes the modification time and read-only directories cannot be written into.
+	dirs []pendingDir
+}
+
+type pendingDir struct {
+	src, dst string
+	st       unix.Stat_t
+}
+
+// copyParents creates the missing parent directories of dst with the metadata of the parent directories of src.
+func (c *copier) copyParents(src, dst string) error {
+	var missing []pendingDir
+	for s, d := filepath.Dir(src), filepath.Dir(dst); ; s, d = filepath.Dir(s), filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil {
+			break
+		}
+		var st unix.Stat_t
+		if err := unix.Stat(s, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFDIR || s == filepath.Dir(s) {
+			// Either src is exhausted or the parent is gone, the rest is created with the default permissions.
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				return err
+			}
+			break
+		}
+		missing = append(missing, pendingDir{src: s, dst: d, st: st})
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i].dst, 0o700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		c.dirs = append(c.dirs, missing[i])
+	}
+	return nil
+}
+
+func (c *copier) copyEntry(srcPath, dstPath string, st *unix.Stat_t, jobs chan<- fileJob) error {
+	mode := st.Mode & unix.S_IFMT
+	if mode == unix.S_IFREG && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := c.links[id]; ok {
+			c.pendingLinks = append(c.pendingLinks, pendingLink{first: first, dst: dstPath})
+			return nil
+		}
+		c.links[id] = dstPath
+	}
+	if c.incremental && unchanged(dstPath, st) {
+		return nil
+	}
+	linked, err := prepareDestination(dstPath, mode == unix.S_IFDIR)
+	if err != nil {
+		return err
+	}
+	if linked {
+		// The contents are merged into the target of the symlink, whose metadata is left as is, e.g. /lib in images
+		// with merged /usr.
+		return nil
+	}
+	switch mode {
+	case unix.S_IFDIR:
+		// The directory is kept writable until its contents are copied, see finish.
+		if err := os.Mkdir(dstPath, 0o700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if c.incremental {
+			if err := pruneDir(srcPath, dstPath, c.include); err != nil {
+				return fmt.Errorf("failed to remove deleted files from %s: %w", dstPath, err)
+			}
+		}
+		c.dirs = append(c.dirs, pendingDir{src: srcPath, dst: dstPath, st: *st})
+		return nil
+	case unix.S_IFLNK:
+		target, err := os.Readlink(srcPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dstPath); err != nil {
+			return err
+		}
+	case unix.S_IFREG:
+		jobs <- fileJob{src: srcPath, dst: dstPath, st: *st}
+		return nil
+	default:
+		// Character and block devices, FIFOs and sockets.
+		if err := unix.Mknod(dstPath, st.Mode, int(st.Rdev)); err != nil {
+			return fmt.Errorf("failed to create special file %s: %w", dstPath, err)
+		}
+	}
+	return applyMetadata(srcPath, dstPath, st)
+}
+
+// link makes dst a hardlink of first unless it already is.
+func (c *copier) link(first, dst string) error {
+	var a, b unix.Stat_t
+	if c.incremental && unix.Lstat(first, &a) == nil && unix.Lstat(dst, &b) == nil && a.Dev == b.Dev && a.Ino == b.Ino {
+		return nil
+	}
+	if _, err := prepareDestination(dst, false); err != nil {
+		return err
+	}
+	return os.Link(first, dst)
+}
+
+// unchanged returns true if the file at dst is a copy of the file with the given stat that is up to date. Directories
+// are never considered unchanged since their contents need to be walked.
+func unchanged(dst string, src *unix.Stat_t) bool {
+	var st unix.Stat_t
+	if err := unix.Lstat(dst, &st); err != nil {
+		return false
+	}
+	if src.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return false
+	}
+	return st.Mode == src.Mode && st.Size == src.Size && st.Mtim == src.Mtim && st.Uid == src.Uid && st.Gid == src.Gid
+}
+
+// pruneDir removes the entries of dst that do not exist in src or are not included by the given filter.
+func pruneDir(src, dst string, include func(string, bool) bool) error {
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		srcPath := filepath.Join(src, e.Name())
+		fi, err := os.Lstat(srcPath)
+		if err == nil && (include == nil || include(srcPath, fi.IsDir())) {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish applies the metadata of the copied directories, deepest first.
+func (c *copier) finish() error {
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		d := c.dirs[i]
+		if err := applyMetadata(d.src, d.dst, &d.st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareDestination removes what is at the given path unless both it and the source are directories. A symlink to a
+// directory counts as a directory, in which case true is returned.
+func prepareDestination(p string, isDir bool) (bool, error) {
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if isDir && isDirOrLinkToDir(p, fi) {
+		return fi.Mode()&os.ModeSymlink != 0, nil
+	}
+	return false, os.RemoveAll(p)
+}
+
+// isDirOrLinkToDir returns true if the file at the given path with the given info is a directory or a symlink that
+// resolves to one.
+func isDirOrLinkToDir(p string, fi os.FileInfo) bool {
+	if fi.IsDir() {
+		return true
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := os.Stat(p)
+	return err == nil && target.IsDir()
+}
+
+// copyRegularFile copies the contents of the file. Filesystems that support reflinks, e.g. btrfs and XFS, share the
+// extents instead of copying them. Otherwise, the data is copied in the kernel with copy_file_range skipping the holes
+// so that sparse files stay sparse.
+func copyRegularFile(srcPath, dstPath string, size int64) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return dst.Close()
+	}
+	var off int64
+	for off < size {
+		data, err := unix.Seek(int(src.Fd()), off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// The rest of the file is a hole.
+			break
+		}
+		if err != nil {
+			// The filesystem does not support finding holes, so everything is copied.
+			data = off
+		}
+		hole, err := unix.Seek(int(src.Fd()), data, unix.SEEK_HOLE)
+		if err != nil {
+			hole = size
+		}
+		if err := copyFileRange(dst, src, data, hole-data); err != nil {
+			return err
+		}
+		off = hole
+	}
+	// Trailing holes are not written, so the size is set explicitly.
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// copyFileRange copies n bytes at the given offset of src to the same offset of dst.
+func copyFileRange(dst, src *os.File, off, n int64) error {
+	for n > 0 {
+		roff, woff := off, off
+		c, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(n), 0)
+		if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) ||
+			errors.Is(err, unix.EOPNOTSUPP) {
+			// Older kernels do not support copying across filesystems, so the data goes through user space.
+			_, err := io.Copy(io.NewOffsetWriter(dst, off), io.NewSectionReader(src, off, n))
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			// The file was truncated in the meantime.
+			return nil
+		}
+		off += int64(c)
+		n -= int64(c)
+	}
+	return nil
+}
+
+// applyMetadata copies the ownership, permissions, extended attributes and timestamps of src to dst.
+func applyMetadata(src, dst string, st *unix.Stat_t) error {
+	if err := unix.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EINVAL) {
+		// Without CAP_CHOWN, e.g. in unprivileged mode, or with IDs not mapped in the user namespace, the files are
+		// owned by crik's user.
+		return fmt.Errorf("failed to change owner of %s: %w", dst, err)
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		return fmt.Errorf("failed to copy extended attributes of %s: %w", src, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+		// Chown clears setuid and setgid bits, so the mode is set after it.
+		if err := unix.Chmod(dst, st.Mode&0o7777); err != nil {
+			return fmt.Errorf("failed to change mode of %s: %w", dst, err)
+		}
+	}
+	ts := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to change times of %s: %w", dst, err)
+	}
+	return nil
+}
+
+// copyXattrs copies the extended attributes of src to dst. Attributes that the destination filesystem does not support
+// or crik is not allowed to set, e.g. trusted.* without CAP_SYS_ADMIN, are skipped.
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return err
+	}
+	for _, name := range splitNullTerminated(buf[:size]) {
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(src, name, value); err != nil {
+			continue
+		}
+		err = unix.Lsetxattr(dst, name, value[:vsize], 0)
+		if err != nil && !errors.Is(err, unix.ENOTSUP) && !errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func splitNullTerminated(b []byte) []string {
+	var result []string
+	start := 0
+	for i, c := range b {
+		if c == 0 {
+			if i > start {
+				result = append(result, string(b[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return result
+}
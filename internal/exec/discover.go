@@ -0,0 +1,217 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// clockTicksPerSecond is USER_HZ, which is 100 on all architectures Linux supports today.
+	clockTicksPerSecond = 100
+)
+
+// DiscoverModifiedFiles returns the regular files opened or mapped by the dumped process tree in the given image
+// directory that live on the root filesystem of the container and were created or modified after it started. These
+// files are not part of the image of the new container, so they need to travel with the checkpoint.
+func DiscoverModifiedFiles(imageDir string) ([]string, error) {
+	c := crit.New(nil, nil, imageDir, false, false)
+	var candidates []string
+	fds, err := c.ExploreFds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to explore fds: %w", err)
+	}
+	for _, fd := range fds {
+		for _, file := range fd.Files {
+			if file.Type == "REG" {
+				candidates = append(candidates, file.Path)
+			}
+		}
+	}
+	mems, err := c.ExploreMems()
+	if err != nil {
+		return nil, fmt.Errorf("failed to explore memory mappings: %w", err)
+	}
+	for _, m := range mems {
+		for _, mem := range m.Mems {
+			if strings.HasPrefix(mem.Resource, "/") {
+				candidates = append(candidates, mem.Resource)
+			}
+		}
+	}
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	var root unix.Stat_t
+	if err := unix.Stat("/", &root); err != nil {
+		return nil, fmt.Errorf("failed to stat root filesystem: %w", err)
+	}
+	started, err := ContainerStartTime()
+	if err != nil {
+		return nil, err
+	}
+	upperDir := rootUpperDir()
+	imageDir = filepath.Clean(imageDir)
+	var result []string
+	for _, p := range candidates {
+		if p == imageDir || strings.HasPrefix(p, imageDir+"/") {
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG {
+			// Deleted files are dumped by criu as ghost files.
+			continue
+		}
+		if st.Dev != root.Dev {
+			// Files on volumes are not part of the image.
+			continue
+		}
+		if upperDir != "" {
+			if _, err := os.Lstat(filepath.Join(upperDir, p)); err == nil {
+				result = append(result, p)
+			}
+			continue
+		}
+		if time.Unix(st.Ctim.Unix()).After(started) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// pruneExtraFiles removes the files in the extra files directory that were discovered in an earlier checkpoint but not
+// in this one. The files of AdditionalPaths are kept since their copies are kept in sync with the originals.
+func pruneExtraFiles(cfg Configuration, discovered []string) error {
+	dir := filepath.Join(cfg.ImageDir, ExtraFilesDirName)
+	keep := map[string]bool{}
+	for _, p := range discovered {
+		keep[p] = true
+	}
+	var dirs []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		orig := filepath.Join("/", strings.TrimPrefix(p, dir))
+		for _, a := range cfg.AdditionalPaths {
+			if isUnder(orig, a.root()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() {
+			if p != dir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if keep[orig] {
+			return nil
+		}
+		return os.Remove(p)
+	})
+	if err != nil {
+		return err
+	}
+	// Directories that are left empty are removed deepest first, the others are ancestors of the kept files.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContainerStartTime returns the start time of crik, which is the entrypoint of the container. PID 1 is not used since
+// it's the pause container when the pod shares its PID namespace. crik is used rather than the wrapped process since
+// a restored process tree starts after the files of the checkpoint are put back.
+func ContainerStartTime() (time.Time, error) {
+	return ProcessStartTime(os.Getpid())
+}
+
+// ProcessStartTime returns the start time of the given process.
+func ProcessStartTime(pid int) (time.Time, error) {
+	statPath := filepath.Join("/proc", strconv.Itoa(pid), "stat")
+	stat, err := os.ReadFile(statPath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s: %w", statPath, err)
+	}
+	// The command name may contain spaces, so the fields are counted from its closing parenthesis.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	// starttime is the 22nd field while the state, which is the 3rd, is the first one after the command name.
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected format of %s", statPath)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse start time: %w", err)
+	}
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read /proc/stat: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		v, ok := strings.CutPrefix(line, "btime ")
+		if !ok {
+			continue
+		}
+		btime, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse boot time: %w", err)
+		}
+		return time.Unix(btime, 0).Add(time.Duration(ticks) * time.Second / clockTicksPerSecond), nil
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
+
+// rootUpperDir returns the upper directory of the overlay filesystem mounted at root if it's accessible from the
+// container, which is usually not the case since it's a path on the host.
+func rootUpperDir() string {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return ""
+	}
+	for _, m := range mounts {
+		if m.MountPoint != "/" || m.FSType != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(m.SuperOptions, ",") {
+			if dir, ok := strings.CutPrefix(opt, "upperdir="); ok {
+				if _, err := os.Stat(dir); err == nil {
+					return dir
+				}
+			}
+		}
+	}
+	return ""
+}
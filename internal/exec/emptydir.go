@@ -0,0 +1,201 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// EmptyDirsDirName is the directory in the image directory where the contents of emptyDir volumes are kept.
+	EmptyDirsDirName = "emptyDirs"
+
+	// emptyDirPluginDir is the directory kubelet creates emptyDir volumes in.
+	emptyDirPluginDir = "kubernetes.io~empty-dir"
+
+	// ShmDir is where POSIX shared memory objects live. It's a tmpfs local to the pod, so it's handled the same way
+	// as emptyDir volumes.
+	ShmDir = "/dev/shm"
+)
+
+// EmptyDirConfiguration configures carrying the contents of emptyDir volumes to the new pod. emptyDir volumes are
+// created empty in the new pod, so the files the process tree has open on them would be missing during restore.
+type EmptyDirConfiguration struct {
+	// Disabled disables carrying the contents of emptyDir volumes.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Paths is the list of mount points of emptyDir volumes in addition to the detected ones. Volumes with medium
+	// Memory cannot be told apart from other tmpfs mounts, so they need to be listed here.
+	Paths []string `json:"paths,omitempty"`
+
+	// MaxSize is the limit of the total size of the files of each volume, e.g. 1Gi. Unlimited if not given.
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+
+	// OverLimit is the policy applied when the files of a volume exceed MaxSize, see AdditionalPath.
+	OverLimit OverLimitPolicy `json:"overLimit,omitempty"`
+}
+
+// EmptyDirMounts returns the mount points of the emptyDir volumes of the container and /dev/shm, leaving out the one of
+// the image directory since it's expected to be carried to the new pod as is.
+func EmptyDirMounts(cfg Configuration) ([]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	if cfg.EmptyDirs != nil {
+		for _, p := range cfg.EmptyDirs.Paths {
+			result = append(result, filepath.Clean(p))
+		}
+	}
+	for _, m := range mounts {
+		switch {
+		case strings.Contains(m.Root, "/"+emptyDirPluginDir+"/"):
+			result = append(result, m.MountPoint)
+		case m.MountPoint == ShmDir && !cfg.DisableShmCapture:
+			result = append(result, m.MountPoint)
+		}
+	}
+	result = slices.DeleteFunc(result, func(p string) bool {
+		return cfg.ImageDir != "" && isUnder(filepath.Clean(cfg.ImageDir), p)
+	})
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
+
+// UsedEmptyDirs returns the mount points among the given ones on which the given processes have files open or mapped,
+// or their working directory.
+func UsedEmptyDirs(pids []int, mounts []string) []string {
+	var paths []string
+	for _, pid := range pids {
+		for _, target := range readFds(pid) {
+			paths = append(paths, strings.TrimSuffix(target, " (deleted)"))
+		}
+		if cwd, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "cwd")); err == nil {
+			paths = append(paths, cwd)
+		}
+		paths = append(paths, mappedFiles(pid)...)
+	}
+	var result []string
+	for _, m := range mounts {
+		for _, p := range paths {
+			if isUnder(p, m) {
+				result = append(result, m)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// mappedFiles returns the paths of the files mapped by the given process.
+func mappedFiles(pid int) []string {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var result []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Format: address perms offset dev inode pathname
+		fields := strings.SplitN(s.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		p := strings.TrimSuffix(strings.TrimSpace(fields[5]), " (deleted)")
+		if strings.HasPrefix(p, "/") {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// SnapshotEmptyDirs copies the contents of the emptyDir volumes and /dev/shm used by the process tree rooted at the
+// given PID into the image directory and returns the volumes it copied. Deleted shared memory objects, which browsers
+// use a lot, are dumped by criu as ghost files instead. The copies of the volumes that are not used anymore are removed.
+func SnapshotEmptyDirs(cfg Configuration, pid int) ([]string, error) {
+	dst := filepath.Join(cfg.ImageDir, EmptyDirsDirName)
+	var used []string
+	if cfg.EmptyDirs == nil || !cfg.EmptyDirs.Disabled {
+		mounts, err := EmptyDirMounts(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find emptyDir volumes: %w", err)
+		}
+		pids, err := ProcessTree(pid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list process tree: %w", err)
+		}
+		used = UsedEmptyDirs(pids, mounts)
+	}
+	var entries []AdditionalPath
+	for _, m := range used {
+		e := AdditionalPath{Path: m}
+		if cfg.EmptyDirs != nil {
+			e.MaxSize, e.OverLimit = cfg.EmptyDirs.MaxSize, cfg.EmptyDirs.OverLimit
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, os.RemoveAll(dst)
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return nil, err
+	}
+	if err := pruneUnusedEmptyDirs(dst, entries); err != nil {
+		return nil, err
+	}
+	if err := syncAdditionalPaths(entries, dst, cfg.ImageDir, cfg.GetCopyWorkers()); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Included the contents of pod-local volumes %v\n", used)
+	return used, nil
+}
+
+// pruneUnusedEmptyDirs removes the copies of the volumes other than the given ones.
+func pruneUnusedEmptyDirs(dst string, entries []AdditionalPath) error {
+	return filepath.WalkDir(dst, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == dst {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(p, dst+"/")
+		for _, e := range entries {
+			if rel == e.Path {
+				return filepath.SkipDir
+			}
+			if isUnder(e.Path, rel) {
+				// An ancestor of a used volume.
+				return nil
+			}
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExternalUnixSocket is a listening Unix socket outside of the process tree that the process tree may be connected
+// to, e.g. the one of a sidecar container on a shared volume. The connections to it are cut during dump and the
+// restored process tree gets new connections to the same socket in the new pod in their place.
+type ExternalUnixSocket struct {
+	// Path is the path the socket is bound to. Abstract sockets are given with a leading "@".
+	Path string `json:"path"`
+
+	// PathInRestore is the path to connect to in the new pod. Defaults to Path.
+	PathInRestore string `json:"pathInRestore,omitempty"`
+}
+
+// externalUnixConnection is a socket of the process tree connected to an ExternalUnixSocket.
+type externalUnixConnection struct {
+	// Inode is the inode of the socket in the process tree.
+	Inode uint32 `json:"inode"`
+	// Type is SOCK_STREAM, SOCK_DGRAM or SOCK_SEQPACKET.
+	Type uint8 `json:"type"`
+	// Path is the path to connect to during restore.
+	Path string `json:"path"`
+}
+
+// inheritedFd is a file descriptor of the root of the process tree that is passed from crik.
+type inheritedFd struct {
+	Fd int `json:"fd"`
+	// Key is the target of the file descriptor during dump, e.g. pipe:[1234], which criu looks up during restore.
+	Key string `json:"key"`
+}
+
+// ExternalUnixConnections returns the sockets of the process tree rooted at the given PID that are connected to one of
+// the configured external Unix sockets.
+func ExternalUnixConnections(pid int, sockets []ExternalUnixSocket) ([]externalUnixConnection, error) {
+	if len(sockets) == 0 {
+		return nil, nil
+	}
+	pids, err := ProcessTree(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list process tree: %w", err)
+	}
+	all, err := ListUnixSockets()
+	if err != nil {
+		return nil, err
+	}
+	var result []externalUnixConnection
+	seen := map[uint32]bool{}
+	for _, p := range pids {
+		for _, target := range readFds(p) {
+			inode, ok := socketInode(target)
+			if !ok || seen[inode] {
+				continue
+			}
+			s, ok := all[inode]
+			if !ok || s.Peer == 0 {
+				continue
+			}
+			peer, ok := all[s.Peer]
+			if !ok {
+				continue
+			}
+			i := slices.IndexFunc(sockets, func(e ExternalUnixSocket) bool { return e.Path == peer.Name })
+			if i < 0 {
+				continue
+			}
+			seen[inode] = true
+			path := sockets[i].PathInRestore
+			if path == "" {
+				path = sockets[i].Path
+			}
+			result = append(result, externalUnixConnection{Inode: inode, Type: s.Type, Path: path})
+		}
+	}
+	return result, nil
+}
+
+// GetExternalUnixSocketsForCheckpoint returns the values of the external option of criu for the given connections.
+func GetExternalUnixSocketsForCheckpoint(conns []externalUnixConnection) []string {
+	var result []string
+	for _, c := range conns {
+		result = append(result, fmt.Sprintf("unix[%d]", c.Inode))
+	}
+	return result
+}
+
+// connect opens a new connection to the socket in the new pod and returns it with the key criu expects in
+// --inherit-fd for the socket in the checkpoint.
+func (c externalUnixConnection) connect() (string, *os.File, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, int(c.Type)|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrUnix{Name: c.Path}); err != nil {
+		unix.Close(fd)
+		return "", nil, fmt.Errorf("failed to connect to %s: %w", c.Path, err)
+	}
+	return fmt.Sprintf("socket:[%d]", c.Inode), os.NewFile(uintptr(fd), c.Path), nil
+}
+
+// readInheritedFds returns the targets of the given file descriptors of the process. The ones that are not open are
+// left out.
+func readInheritedFds(pid int, fds []int) []inheritedFd {
+	var result []inheritedFd
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "fd", strconv.Itoa(fd)))
+		if err != nil {
+			continue
+		}
+		result = append(result, inheritedFd{Fd: fd, Key: link})
+	}
+	return result
+}
+
+// ExternalInheritedFiles returns the files criu needs to be given with --inherit-fd to restore the connections to the
+// external Unix sockets and the inherited file descriptors, together with their keys.
+func ExternalInheritedFiles(conns []externalUnixConnection, fds []inheritedFd) ([]string, []*os.File, error) {
+	var keys []string
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, c := range conns {
+		key, f, err := c.connect()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		files = append(files, f)
+	}
+	for _, fd := range fds {
+		// crik is expected to get the same file descriptors from its parent in the new pod.
+		if _, err := unix.FcntlInt(uintptr(fd.Fd), unix.F_GETFD, 0); err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("file descriptor %d in place of %s is not open: %w", fd.Fd, fd.Key, err)
+		}
+		keys = append(keys, fd.Key)
+		files = append(files, os.NewFile(uintptr(fd.Fd), fd.Key))
+	}
+	return keys, files, nil
+}
+
+// InheritedFiles returns the extra files the wrapped command is started with so that it gets the given file
+// descriptors of crik at the same numbers.
+func InheritedFiles(fds []int) []*os.File {
+	var result []*os.File
+	for _, fd := range fds {
+		if fd < 3 {
+			continue
+		}
+		for len(result) <= fd-3 {
+			result = append(result, nil)
+		}
+		result[fd-3] = os.NewFile(uintptr(fd), "fd"+strconv.Itoa(fd))
+	}
+	return result
+}
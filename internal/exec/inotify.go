@@ -0,0 +1,280 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// InotifyWatch is a watch of an inotify instance of a process.
+type InotifyWatch struct {
+	PID int
+	FD  int
+	// Major and Minor are the device numbers of the filesystem of the watched inode.
+	Major uint32
+	Minor uint32
+	Inode uint64
+	// HandleType and Handle are the file handle of the watched inode, which criu opens with open_by_handle_at during
+	// dump. Empty if the kernel does not report it.
+	HandleType int32
+	Handle     []byte
+}
+
+// ListInotifyWatches returns the watches of all inotify instances opened by the given processes, read from
+// /proc/<pid>/fdinfo.
+func ListInotifyWatches(pids []int) ([]InotifyWatch, error) {
+	var result []InotifyWatch
+	for _, pid := range pids {
+		for fd, target := range readFds(pid) {
+			if target != "anon_inode:inotify" {
+				continue
+			}
+			watches, err := readInotifyFdInfo(pid, fd)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, watches...)
+		}
+	}
+	return result, nil
+}
+
+// readInotifyFdInfo parses lines like the following:
+// inotify wd:1 ino:2ffb5b sdev:800001 mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:1 f_handle:5bfb2f00ea2c2a6b
+func readInotifyFdInfo(pid, fd int) ([]InotifyWatch, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "fdinfo", strconv.Itoa(fd)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open fdinfo of fd %d of %d: %w", fd, pid, err)
+	}
+	defer f.Close()
+	return parseInotifyFdInfo(f, pid, fd)
+}
+
+// parseInotifyFdInfo parses the fdinfo of the given inotify file descriptor, see readInotifyFdInfo.
+func parseInotifyFdInfo(r io.Reader, pid, fd int) ([]InotifyWatch, error) {
+	var result []InotifyWatch
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line, ok := strings.CutPrefix(s.Text(), "inotify ")
+		if !ok {
+			continue
+		}
+		w := InotifyWatch{PID: pid, FD: fd}
+		for _, field := range strings.Fields(line) {
+			k, v, _ := strings.Cut(field, ":")
+			var err error
+			switch k {
+			case "ino":
+				w.Inode, err = strconv.ParseUint(v, 16, 64)
+			case "fhandle-type":
+				var t int64
+				t, err = strconv.ParseInt(v, 16, 32)
+				w.HandleType = int32(t)
+			case "f_handle":
+				w.Handle, err = hex.DecodeString(v)
+			case "sdev":
+				var dev uint64
+				dev, err = strconv.ParseUint(v, 16, 32)
+				// The kernel-internal encoding of dev_t, i.e. MKDEV.
+				w.Major, w.Minor = uint32(dev>>20), uint32(dev&0xfffff)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %q in fdinfo of fd %d of %d: %w", field, fd, pid, err)
+			}
+		}
+		result = append(result, w)
+	}
+	return result, s.Err()
+}
+
+// ResolveInodes finds the paths of the given inodes on the filesystem with the given device numbers by walking its
+// mount points. Inodes that cannot be found are not included in the result.
+func ResolveInodes(major, minor uint32, inodes []uint64) (map[uint64]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	result := map[uint64]string{}
+	for _, m := range mounts {
+		if m.Major != major || m.Minor != minor || len(result) == len(inodes) {
+			continue
+		}
+		var root unix.Stat_t
+		if err := unix.Stat(m.MountPoint, &root); err != nil {
+			continue
+		}
+		_ = filepath.WalkDir(m.MountPoint, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Keep walking in case of permission errors and files removed during the walk.
+				return nil
+			}
+			var st unix.Stat_t
+			if err := unix.Lstat(p, &st); err != nil {
+				return nil
+			}
+			if st.Dev != root.Dev {
+				// Another filesystem is mounted here. Returning SkipDir for a file, e.g. a bind-mounted /etc/hosts,
+				// would skip the rest of its directory.
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if slices.Contains(inodes, st.Ino) {
+				if _, ok := result[st.Ino]; !ok {
+					result[st.Ino] = p
+				}
+				if len(result) == len(inodes) {
+					return filepath.SkipAll
+				}
+			}
+			return nil
+		})
+	}
+	return result, nil
+}
+
+// DetectInotifyIncompatiblePaths returns the paths watched by the inotify instances of the given processes that
+// criu will not be able to dump, i.e. the ones whose file handles cannot be opened, which is the case on overlay
+// filesystems without nfs_export. The handles are opened the same way criu does, so watches criu can dump are left
+// alone. An error is returned if the handles cannot be tested, e.g. without CAP_DAC_READ_SEARCH, in which case the paths
+// can be found from the log of a failed dump instead, see ParseInotifyFailures.
+func DetectInotifyIncompatiblePaths(pids []int) ([]string, error) {
+	watches, err := ListInotifyWatches(pids)
+	if err != nil {
+		return nil, err
+	}
+	if len(watches) == 0 {
+		return nil, nil
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	byDevice := map[[2]uint32][]uint64{}
+	for _, w := range watches {
+		dev := [2]uint32{w.Major, w.Minor}
+		if len(w.Handle) == 0 || slices.Contains(byDevice[dev], w.Inode) {
+			continue
+		}
+		openable, err := canOpenHandle(mounts, w)
+		if err != nil {
+			return nil, err
+		}
+		if !openable {
+			byDevice[dev] = append(byDevice[dev], w.Inode)
+		}
+	}
+	var result []string
+	for dev, inodes := range byDevice {
+		paths, err := ResolveInodes(dev[0], dev[1], inodes)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			result = append(result, p)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// canOpenHandle returns true if the file handle of the watch can be opened through a mount point of its filesystem.
+// An error is returned if it cannot be tested.
+func canOpenHandle(mounts []mountInfo, w InotifyWatch) (bool, error) {
+	for _, m := range mounts {
+		if m.Major != w.Major || m.Minor != w.Minor {
+			continue
+		}
+		mfd, err := unix.Open(m.MountPoint, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		fd, err := unix.OpenByHandleAt(mfd, unix.NewFileHandle(w.HandleType, w.Handle), unix.O_PATH|unix.O_CLOEXEC)
+		unix.Close(mfd)
+		if err == nil {
+			unix.Close(fd)
+			return true, nil
+		}
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOSYS) {
+			return false, fmt.Errorf("failed to test file handle of inode %d: %w", w.Inode, err)
+		}
+		return false, nil
+	}
+	// The filesystem is not mounted in the container, so criu cannot open it either.
+	return false, nil
+}
+
+// fsnotifyHandleRegex matches criu log lines like "fsnotify: 	Handle 0x278:0x2ffb5b cannot be opened".
+var fsnotifyHandleRegex = regexp.MustCompile(`Handle 0x([0-9a-f]+):0x([0-9a-f]+) cannot be opened`)
+
+// ParseInotifyFailures returns the paths of the inotify watches criu reported as unopenable in the given log file.
+func ParseInotifyFailures(logPath string) ([]string, error) {
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", logPath, err)
+	}
+	var result []string
+	for dev, inodes := range parseInotifyFailures(string(b)) {
+		paths, err := ResolveInodes(dev[0], dev[1], inodes)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			result = append(result, p)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// parseInotifyFailures returns the inodes of the watches criu reported as unopenable in the given log, keyed by the
+// major and minor numbers of their device.
+func parseInotifyFailures(log string) map[[2]uint32][]uint64 {
+	byDevice := map[[2]uint32][]uint64{}
+	for _, m := range fsnotifyHandleRegex.FindAllStringSubmatch(log, -1) {
+		dev, err := strconv.ParseUint(m[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(m[2], 16, 64)
+		if err != nil {
+			continue
+		}
+		key := [2]uint32{uint32(dev >> 20), uint32(dev & 0xfffff)}
+		if !slices.Contains(byDevice[key], inode) {
+			byDevice[key] = append(byDevice[key], inode)
+		}
+	}
+	return byDevice
+}
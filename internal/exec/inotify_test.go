@@ -0,0 +1,129 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInotifyFdInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		fdinfo  string
+		want    []InotifyWatch
+		wantErr bool
+	}{
+		{
+			name:   "no watches",
+			fdinfo: "pos:\t0\nflags:\t02004000\nmnt_id:\t15\nino:\t1057\n",
+		},
+		{
+			name: "watches with file handles",
+			fdinfo: "pos:\t0\nflags:\t02004000\n" +
+				"inotify wd:1 ino:2ffb5b sdev:800001 mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:1 f_handle:5bfb2f00ea2c2a6b\n" +
+				"inotify wd:2 ino:10 sdev:2b mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:81 f_handle:1000000000000000\n",
+			want: []InotifyWatch{
+				{PID: 7, FD: 3, Major: 8, Minor: 1, Inode: 0x2ffb5b, HandleType: 1,
+					Handle: []byte{0x5b, 0xfb, 0x2f, 0x00, 0xea, 0x2c, 0x2a, 0x6b}},
+				{PID: 7, FD: 3, Major: 0, Minor: 0x2b, Inode: 0x10, HandleType: 0x81,
+					Handle: []byte{0x10, 0, 0, 0, 0, 0, 0, 0}},
+			},
+		},
+		{
+			name:   "watch without file handle",
+			fdinfo: "inotify wd:1 ino:a sdev:800002 mask:fc6 ignored_mask:0\n",
+			want:   []InotifyWatch{{PID: 7, FD: 3, Major: 8, Minor: 2, Inode: 0xa}},
+		},
+		{
+			name:    "malformed inode",
+			fdinfo:  "inotify wd:1 ino:xyz sdev:800001 mask:fc6 ignored_mask:0\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed handle",
+			fdinfo:  "inotify wd:1 ino:a sdev:800001 mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:1 f_handle:5bf\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInotifyFdInfo(strings.NewReader(tt.fdinfo), 7, 3)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseInotifyFdInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInotifyFdInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInotifyFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want map[[2]uint32][]uint64
+	}{
+		{
+			name: "no failures",
+			log:  "(00.012345) fsnotify: \tDumping /proc/1/fdinfo/3\n",
+			want: map[[2]uint32][]uint64{},
+		},
+		{
+			name: "failures on several devices",
+			log: "(00.012345) Error (criu/fsnotify.c:284): fsnotify: \tHandle 0x800001:0x2ffb5b cannot be opened\n" +
+				"(00.012346) Error (criu/fsnotify.c:284): fsnotify: \tHandle 0x2b:0x10 cannot be opened\n" +
+				"(00.012347) Error (criu/fsnotify.c:284): fsnotify: \tHandle 0x800001:0x2ffb5c cannot be opened\n" +
+				"(00.012348) Error (criu/fsnotify.c:284): fsnotify: \tHandle 0x800001:0x2ffb5b cannot be opened\n",
+			want: map[[2]uint32][]uint64{
+				{8, 1}:    {0x2ffb5b, 0x2ffb5c},
+				{0, 0x2b}: {0x10},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseInotifyFailures(tt.log); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInotifyFailures() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInotifyFailuresMissingLog(t *testing.T) {
+	if _, err := ParseInotifyFailures(filepath.Join(t.TempDir(), "dump.log")); err == nil {
+		t.Error("ParseInotifyFailures() succeeded without a log")
+	}
+}
+
+func TestParseInotifyFailuresWithoutFailures(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "dump.log")
+	if err := os.WriteFile(logPath, []byte("(00.000001) Dumping finished successfully\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseInotifyFailures(logPath)
+	if err != nil {
+		t.Fatalf("ParseInotifyFailures() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("ParseInotifyFailures() = %v, want none", got)
+	}
+}
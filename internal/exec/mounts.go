@@ -0,0 +1,189 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// internalFSTypes are the filesystems that are either recreated by criu or by the container runtime, so they are not
+// marked as external mounts.
+var internalFSTypes = []string{
+	"proc", "sysfs", "cgroup", "cgroup2", "devpts", "mqueue", "securityfs", "debugfs", "tracefs", "bpf", "fusectl",
+	"configfs", "pstore", "hugetlbfs",
+}
+
+// mountInfo is an entry in /proc/self/mountinfo.
+type mountInfo struct {
+	Major        uint32
+	Minor        uint32
+	Root         string
+	MountPoint   string
+	FSType       string
+	Source       string
+	Options      string
+	SuperOptions string
+}
+
+// readMountInfo parses /proc/self/mountinfo.
+func readMountInfo() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mountinfo: %w", err)
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses entries in the format of /proc/<pid>/mountinfo.
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var result []mountInfo
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// Format: id parent major:minor root mountpoint options [optional fields] - fstype source super-options
+		pre, post, ok := strings.Cut(s.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields, postFields := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 6 || len(postFields) < 2 {
+			continue
+		}
+		m := mountInfo{
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FSType:     postFields[0],
+			Source:     postFields[1],
+		}
+		if len(postFields) > 2 {
+			m.SuperOptions = postFields[2]
+		}
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &m.Major, &m.Minor); err != nil {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, s.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes the kernel uses for space, tab, newline and backslash.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	r := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return r.Replace(s)
+}
+
+// ExternalMounts returns the mounts that criu needs to treat as external, i.e. the ones whose contents are provided by
+// the container runtime in the new container, such as ConfigMaps, Secrets, service account tokens, /etc/hosts and
+// other volumes. They are found in /proc/self/mountinfo together with DirectoryMounts and the configured additions,
+// leaving out the configured exclusions.
+func ExternalMounts(cfg Configuration) ([]DirectoryMount, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	candidates := slices.Clone(cfg.ExternalMounts)
+	candidates = append(candidates, DirectoryMounts...)
+	for _, m := range mounts {
+		if !isExternalMount(m) {
+			continue
+		}
+		candidates = append(candidates, DirectoryMount{
+			Name:             m.MountPoint,
+			PathInCheckpoint: m.MountPoint,
+			PathInRestore:    m.MountPoint,
+		})
+	}
+	var result []DirectoryMount
+	seen := map[string]bool{}
+	for _, d := range candidates {
+		if seen[d.PathInCheckpoint] || cfg.mountExcluded(d.PathInCheckpoint) {
+			continue
+		}
+		seen[d.PathInCheckpoint] = true
+		if d.Name == "" {
+			d.Name = d.PathInCheckpoint
+		}
+		if d.PathInRestore == "" {
+			d.PathInRestore = d.PathInCheckpoint
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// isExternalMount returns true for the mounts set up by the container runtime except the root filesystem and the
+// kernel filesystems.
+func isExternalMount(m mountInfo) bool {
+	switch {
+	case m.MountPoint == "/":
+		return false
+	case isUnder(m.MountPoint, "/proc") || isUnder(m.MountPoint, "/sys"):
+		// Masked paths of the runtime, e.g. /proc/kcore, are set up again in the new container.
+		return false
+	case slices.Contains(internalFSTypes, m.FSType):
+		return false
+	case m.FSType == "tmpfs" && m.Root == "/" && (m.MountPoint == "/dev" || m.MountPoint == "/dev/shm"):
+		// Created by the runtime for each container, criu dumps their contents.
+		return false
+	}
+	return true
+}
+
+// mountExcluded returns true if the mount point matches one of ExcludedMounts.
+func (c Configuration) mountExcluded(mountPoint string) bool {
+	for _, p := range c.ExcludedMounts {
+		if filepath.Clean(p) == mountPoint || matchGlob(p, mountPoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnderExternalMount returns true if the path is on one of the given mounts.
+func isUnderExternalMount(p string, mounts []DirectoryMount) bool {
+	for _, m := range mounts {
+		if isUnder(p, m.PathInCheckpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExternalMounts makes sure the mount points the restored process tree expects exist in the new container, which
+// criu would otherwise report with a less clear error.
+func checkExternalMounts(mounts []DirectoryMount) error {
+	var missing []string
+	for _, m := range mounts {
+		if _, err := os.Lstat(m.PathInRestore); os.IsNotExist(err) {
+			missing = append(missing, m.PathInRestore)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("external mounts %s do not exist in the new container", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/var/lib/data", want: "/var/lib/data"},
+		{in: `/mnt/my\040volume`, want: "/mnt/my volume"},
+		{in: `/mnt/a\011b`, want: "/mnt/a\tb"},
+		{in: `/mnt/a\012b`, want: "/mnt/a\nb"},
+		{in: `/mnt/a\134b`, want: `/mnt/a\b`},
+		{in: `/mnt/a\134040b`, want: `/mnt/a\040b`},
+		{in: `/mnt/\040\040`, want: "/mnt/  "},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountInfo(tt.in); got != tt.want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountinfo := `2461 2258 0:263 / / rw,relatime master:1004 - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+2464 2461 0:267 / /dev rw,nosuid - tmpfs tmpfs rw,size=65536k,mode=755
+2470 2461 8:1 /var/lib/kubelet/pods/uid/volumes/kubernetes.io~empty-dir/my\040cache /cache rw,relatime - ext4 /dev/sda1 rw
+malformed line
+2471 2461 8:1 /etc/hosts /etc/hosts rw - ext4
+`
+	got, err := parseMountInfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatalf("parseMountInfo() error = %v", err)
+	}
+	want := []mountInfo{
+		{Major: 0, Minor: 263, Root: "/", MountPoint: "/", FSType: "overlay", Source: "overlay",
+			Options: "rw,relatime", SuperOptions: "rw,lowerdir=/l,upperdir=/u,workdir=/w"},
+		{Major: 0, Minor: 267, Root: "/", MountPoint: "/dev", FSType: "tmpfs", Source: "tmpfs",
+			Options: "rw,nosuid", SuperOptions: "rw,size=65536k,mode=755"},
+		{Major: 8, Minor: 1, Root: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~empty-dir/my cache",
+			MountPoint: "/cache", FSType: "ext4", Source: "/dev/sda1", Options: "rw,relatime", SuperOptions: "rw"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo() = %+v, want %+v", got, want)
+	}
+}
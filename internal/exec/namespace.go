@@ -0,0 +1,162 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"slices"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace is a Linux namespace that crik creates for the wrapped process.
+type Namespace string
+
+// Supported namespaces.
+const (
+	NamespaceIPC Namespace = "ipc"
+	NamespacePID Namespace = "pid"
+	// NamespaceTime makes CLOCK_MONOTONIC and CLOCK_BOOTTIME of the process continue from their values at checkpoint
+	// time after restore instead of jumping to the values of the new node.
+	NamespaceTime Namespace = "time"
+	// NamespaceUTS makes the process keep the hostname it had at checkpoint time after restore instead of seeing the
+	// hostname of the new pod.
+	NamespaceUTS Namespace = "uts"
+)
+
+var (
+	// DefaultNamespaces is the list of namespaces created when none is configured and crik has CAP_SYS_ADMIN.
+	DefaultNamespaces = []Namespace{NamespaceIPC}
+)
+
+// NamespacesOrDefault returns the given namespaces or DefaultNamespaces if the list is not set at all. An empty list
+// disables all namespaces. In unprivileged mode, no namespaces are created by default since that requires
+// CAP_SYS_ADMIN.
+func NamespacesOrDefault(namespaces []Namespace) []Namespace {
+	if namespaces == nil {
+		if IsUnprivileged() {
+			return []Namespace{}
+		}
+		return DefaultNamespaces
+	}
+	return namespaces
+}
+
+// NewSysProcAttr returns the attributes to start the wrapped process with in a new session and in the given
+// namespaces.
+func NewSysProcAttr(namespaces []Namespace) (*syscall.SysProcAttr, error) {
+	attr := &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	for _, ns := range namespaces {
+		switch ns {
+		case NamespaceIPC:
+			attr.Unshareflags |= syscall.CLONE_NEWIPC
+		case NamespacePID:
+			// Unsharing PID namespace affects only the children, so the process needs to be cloned into it.
+			attr.Cloneflags |= syscall.CLONE_NEWPID
+		case NamespaceUTS:
+			attr.Unshareflags |= syscall.CLONE_NEWUTS
+		case NamespaceTime:
+			// clone(2) cannot create time namespaces, see StartCommand.
+		default:
+			return nil, fmt.Errorf("unknown namespace %q", ns)
+		}
+	}
+	return attr, nil
+}
+
+// StartCommand starts the command in the given namespaces. The command must be configured with the attributes
+// returned by NewSysProcAttr.
+func StartCommand(cmd *exec.Cmd, namespaces []Namespace) error {
+	if !HasNamespace(namespaces, NamespaceTime) {
+		return cmd.Start()
+	}
+	// unshare(CLONE_NEWTIME) moves only the future children of the calling thread to the new time namespace, so we
+	// fork from a dedicated thread that is never reused since the goroutine exits without unlocking it. Children
+	// created this way by fork and exec enter the namespace only since Linux 5.17, which `crik check` verifies.
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+			errCh <- fmt.Errorf("failed to create time namespace: %w", err)
+			return
+		}
+		errCh <- cmd.Start()
+	}()
+	return <-errCh
+}
+
+// HasNamespace returns true if the given namespace is in the list.
+func HasNamespace(namespaces []Namespace, ns Namespace) bool {
+	return slices.Contains(namespaces, ns)
+}
+
+// RunInit runs the given command as a child of the calling process, which is expected to be the init process of a
+// new PID namespace. The init process of a PID namespace does not get the default signal handlers, reaps orphans and
+// kills every process in the namespace when it exits, so crik takes that role instead of the wrapped command. It
+// forwards the signals in forwardedSignals to the command, reaps zombies and returns once the command exits, with its
+// exit code as ExitCodeError if it failed.
+func RunInit(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("command is required")
+	}
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGCHLD}, forwardedSignals...)...)
+	discardCh := make(chan os.Signal, 32)
+	signal.Notify(discardCh, discardedSignals...)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGCHLD {
+				_ = cmd.Process.Signal(sig)
+				continue
+			}
+			for {
+				var ws syscall.WaitStatus
+				pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+				if err != nil || pid <= 0 {
+					break
+				}
+				if pid != cmd.Process.Pid {
+					continue
+				}
+				code := ws.ExitStatus()
+				if ws.Signaled() {
+					code = 128 + int(ws.Signal())
+				}
+				if code != 0 {
+					return ExitCodeError{Code: code}
+				}
+				return nil
+			}
+		case <-discardCh:
+		}
+	}
+}
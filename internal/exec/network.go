@@ -0,0 +1,185 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// NetworkLockMethod is the tool used to block the traffic of the pod while the process tree is dumped and restored.
+type NetworkLockMethod string
+
+// Network lock methods.
+const (
+	// NetworkLockMethodNone makes crik close TCP connections during dump instead of locking the network.
+	NetworkLockMethodNone     NetworkLockMethod = ""
+	NetworkLockMethodNFTables NetworkLockMethod = "nftables"
+	NetworkLockMethodIPTables NetworkLockMethod = "iptables"
+)
+
+const (
+	networkLockName = "crik-lock"
+)
+
+// NetworkLocker blocks all traffic in the network namespace of the pod except loopback so that the state of the
+// sockets does not change while they are being dumped or restored.
+type NetworkLocker interface {
+	Lock() error
+	Unlock() error
+}
+
+// NewNetworkLocker returns the NetworkLocker for the given method.
+func NewNetworkLocker(method NetworkLockMethod) (NetworkLocker, error) {
+	switch method {
+	case NetworkLockMethodNone:
+		return NopNetworkLocker{}, nil
+	case NetworkLockMethodNFTables:
+		return NFTablesLocker{}, nil
+	case NetworkLockMethodIPTables:
+		return IPTablesLocker{}, nil
+	default:
+		return nil, fmt.Errorf("unknown network lock method %q", method)
+	}
+}
+
+type NopNetworkLocker struct{}
+
+func (NopNetworkLocker) Lock() error   { return nil }
+func (NopNetworkLocker) Unlock() error { return nil }
+
+// NFTablesLocker locks the network using a dedicated nftables table.
+type NFTablesLocker struct{}
+
+// Lock installs a table that drops all non-loopback traffic. The table is recreated if it exists, e.g. when the
+// dump is retried, so that the rules are not duplicated.
+func (NFTablesLocker) Lock() error {
+	rules := strings.Join([]string{
+		// Adding an existing table is a no-op, so deleting it right after never fails and the transaction starts
+		// from an empty table either way.
+		fmt.Sprintf("add table inet %s", networkLockName),
+		fmt.Sprintf("delete table inet %s", networkLockName),
+		fmt.Sprintf("add table inet %s", networkLockName),
+		fmt.Sprintf("add chain inet %s input { type filter hook input priority -300 ; policy drop ; }", networkLockName),
+		fmt.Sprintf("add rule inet %s input iifname \"lo\" accept", networkLockName),
+		fmt.Sprintf("add chain inet %s output { type filter hook output priority -300 ; policy drop ; }", networkLockName),
+		fmt.Sprintf("add rule inet %s output oifname \"lo\" accept", networkLockName),
+	}, "\n")
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to install nftables rules: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// Unlock deletes the table if it exists.
+func (NFTablesLocker) Unlock() error {
+	if err := exec.Command("nft", "list", "table", "inet", networkLockName).Run(); err != nil {
+		// The table does not exist, e.g. we are in a new pod.
+		return nil
+	}
+	if out, err := exec.Command("nft", "delete", "table", "inet", networkLockName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete nftables rules: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// IPTablesLocker locks the network using iptables and ip6tables rules.
+type IPTablesLocker struct{}
+
+var iptablesLockRules = [][]string{
+	{"INPUT", "!", "-i", "lo", "-m", "comment", "--comment", networkLockName, "-j", "DROP"},
+	{"OUTPUT", "!", "-o", "lo", "-m", "comment", "--comment", networkLockName, "-j", "DROP"},
+}
+
+// Lock inserts rules that drop all non-loopback traffic to the top of INPUT and OUTPUT chains. Rules that are already
+// installed are not inserted again and if one of the rules cannot be installed, the ones inserted so far are removed.
+func (IPTablesLocker) Lock() error {
+	type inserted struct {
+		bin  string
+		rule []string
+	}
+	var done []inserted
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, rule := range iptablesLockRules {
+			if err := exec.Command(bin, append([]string{"-w", "-C"}, rule...)...).Run(); err == nil {
+				continue
+			}
+			if out, err := exec.Command(bin, append([]string{"-w", "-I"}, rule...)...).CombinedOutput(); err != nil {
+				for _, r := range done {
+					if dout, derr := exec.Command(r.bin, append([]string{"-w", "-D"}, r.rule...)...).CombinedOutput(); derr != nil {
+						fmt.Printf("Failed to roll back %s rule: %s: %s\n", r.bin, strings.TrimSpace(string(dout)), derr)
+					}
+				}
+				return fmt.Errorf("failed to install %s rule: %s: %w", bin, strings.TrimSpace(string(out)), err)
+			}
+			done = append(done, inserted{bin: bin, rule: rule})
+		}
+	}
+	return nil
+}
+
+// Unlock removes the rules installed by Lock if they exist.
+func (IPTablesLocker) Unlock() error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, rule := range iptablesLockRules {
+			if err := exec.Command(bin, append([]string{"-w", "-C"}, rule...)...).Run(); err != nil {
+				continue
+			}
+			if out, err := exec.Command(bin, append([]string{"-w", "-D"}, rule...)...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to delete %s rule: %s: %w", bin, strings.TrimSpace(string(out)), err)
+			}
+		}
+	}
+	return nil
+}
+
+// podIPs returns the non-loopback addresses of the network namespace of crik, which is the one of the pod.
+func podIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	var ips []string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLoopback() || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, n.IP.String())
+	}
+	return ips, nil
+}
+
+// sameIPs reports whether all the given addresses recorded at dump time are still assigned to the pod. Established TCP
+// connections can be restored only if their local address is still there.
+func sameIPs(dumped []string) bool {
+	current, err := podIPs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range dumped {
+		if !slices.Contains(current, ip) {
+			return false
+		}
+	}
+	return len(dumped) > 0
+}
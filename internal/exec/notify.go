@@ -0,0 +1,98 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/qawolf/crik/pkg/notify"
+)
+
+const (
+	// DefaultNotificationStateFile is the state file used when notifications are enabled without a path.
+	DefaultNotificationStateFile = "/tmp/crik/state.json"
+)
+
+// NotificationConfiguration configures how crik lets the wrapped process know about checkpoint and restore events.
+// See the notify package for the client side of the protocol.
+type NotificationConfiguration struct {
+	// StateFile is the path of the file crik writes the latest event to. Defaults to /tmp/crik/state.json.
+	StateFile string `json:"stateFile,omitempty"`
+
+	// Signal is the name of the signal, e.g. SIGUSR2, that is sent to the wrapped process after the state file is
+	// updated. No signal is sent if not given since the default action of most signals is to terminate the process.
+	Signal string `json:"signal,omitempty"`
+
+	// PreCheckpointDelaySeconds is how long crik waits after announcing the checkpoint before freezing the process so
+	// that it has a chance to react.
+	PreCheckpointDelaySeconds int `json:"preCheckpointDelaySeconds,omitempty"`
+}
+
+// GetStateFile returns the path of the state file.
+func (n *NotificationConfiguration) GetStateFile() string {
+	if n.StateFile == "" {
+		return DefaultNotificationStateFile
+	}
+	return n.StateFile
+}
+
+// Environment returns the environment variables that advertise the protocol to the wrapped process.
+func (n *NotificationConfiguration) Environment() []string {
+	env := []string{fmt.Sprintf("%s=%s", notify.EnvStateFile, n.GetStateFile())}
+	if n.Signal != "" {
+		env = append(env, fmt.Sprintf("%s=%s", notify.EnvSignal, n.Signal))
+	}
+	return env
+}
+
+// Notify writes the event to the state file and signals the process with given PID if a signal is configured.
+func (n *NotificationConfiguration) Notify(pid int, event notify.Event, generation int) error {
+	s := notify.State{
+		Event:      event,
+		Generation: generation,
+		PodName:    os.Getenv("HOSTNAME"),
+		NodeName:   os.Getenv("KUBERNETES_NODE_NAME"),
+		Timestamp:  time.Now().UTC(),
+	}
+	if err := notify.WriteState(n.GetStateFile(), s); err != nil {
+		return err
+	}
+	if n.Signal == "" {
+		return nil
+	}
+	sig, err := notify.ParseSignal(n.Signal)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("failed to send %s to %d: %w", n.Signal, pid, err)
+	}
+	return nil
+}
+
+// CurrentGeneration returns the generation recorded in the state file, or zero if the process has never been
+// restored.
+func (n *NotificationConfiguration) CurrentGeneration() int {
+	s, err := notify.ReadState(n.GetStateFile())
+	if err != nil {
+		return 0
+	}
+	return s.Generation
+}
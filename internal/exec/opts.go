@@ -18,12 +18,9 @@ package exec
 
 import (
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
-	"strings"
+	"time"
 
-	"github.com/checkpoint-restore/go-criu/v7/crit"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
@@ -58,12 +55,108 @@ type Configuration struct {
 	// AdditionalPaths is the list of paths that are not part of the container's image but were opened by one of the
 	// processes in the tree. We need to make sure that these paths are available in the new container as well.
 	// The paths are relative to the root of the container's filesystem.
-	// Entries can be path to a file or a directory.
-	AdditionalPaths []string `json:"additionalPaths,omitempty"`
+	// Entries can be path to a file or a directory, or glob patterns with exclusions and size limits, see
+	// AdditionalPath.
+	// crik discovers the files that are open or mapped during dump, so this list is needed only for the files that
+	// the processes may open after restore, e.g. cache directories.
+	AdditionalPaths []AdditionalPath `json:"additionalPaths,omitempty"`
+
+	// PrestageIntervalSeconds is the interval at which AdditionalPaths are copied into the image directory in the
+	// background while the process runs, so that only the files changed since the last copy are copied during dump.
+	// If not given, AdditionalPaths are copied only during dump.
+	PrestageIntervalSeconds int `json:"prestageIntervalSeconds,omitempty"`
+
+	// CopyWorkers is the number of files copied in parallel. Defaults to the number of CPUs.
+	CopyWorkers int `json:"copyWorkers,omitempty"`
+
+	// ConflictPolicy decides what happens when a file included in the checkpoint exists in the new container with
+	// different contents, e.g. when it's restored with a newer version of the image. Either "overwrite", the default,
+	// "keep-existing" or "fail-on-diff". Every file that is replaced or kept is reported during restore.
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// ConflictPolicies overrides ConflictPolicy for the matching paths. The first matching entry applies.
+	ConflictPolicies []PathConflictPolicy `json:"conflictPolicies,omitempty"`
+
+	// DisableFileDiscovery disables including the open and mapped files that were created or modified after the
+	// container started in the checkpoint automatically.
+	DisableFileDiscovery bool `json:"disableFileDiscovery,omitempty"`
+
+	// RootfsDiff enables including the changes made to the container's root filesystem, i.e. the files added,
+	// modified or deleted after the container started, in the checkpoint and replaying them in the new container before
+	// restore. It is an alternative to listing every path in AdditionalPaths for applications that write outside of
+	// volumes, e.g. caches and downloaded browsers, at the cost of a larger checkpoint.
+	// If the upper directory of the overlay filesystem is not accessible from the container, crik records the list of
+	// files when it starts to find the deleted ones at checkpoint time.
+	RootfsDiff bool `json:"rootfsDiff,omitempty"`
+
+	// ExternalMounts is the list of mounts to mark as external in addition to the ones found in /proc/self/mountinfo,
+	// e.g. to restore a mount at a different path. Entries here take precedence over the found ones with the same
+	// pathInCheckpoint.
+	ExternalMounts []DirectoryMount `json:"externalMounts,omitempty"`
+
+	// ExcludedMounts is the list of mount points or glob patterns of mount points that are not marked as external,
+	// in which case criu dumps the files the process tree has open on them as it does for the root filesystem.
+	ExcludedMounts []string `json:"excludedMounts,omitempty"`
+
+	// EmptyDirs configures carrying the contents of the emptyDir volumes the process tree uses to the new pod, which
+	// is enabled by default.
+	EmptyDirs *EmptyDirConfiguration `json:"emptyDirs,omitempty"`
+
+	// DisableShmCapture disables copying the contents of /dev/shm, i.e. POSIX shared memory objects, into the
+	// checkpoint when the process tree uses them. SysV IPC objects are dumped by criu as part of the "ipc" namespace.
+	DisableShmCapture bool `json:"disableShmCapture,omitempty"`
+
+	// ExternalUnixSockets is the list of Unix sockets outside of the process tree the process tree may be connected
+	// to, e.g. the ones of sidecar containers. crik reconnects the process tree to them in the new pod, so the other
+	// end sees a new connection.
+	ExternalUnixSockets []ExternalUnixSocket `json:"externalUnixSockets,omitempty"`
+
+	// InheritedFds is the list of file descriptors of crik other than stdin, stdout and stderr that are passed to the
+	// wrapped process, e.g. pipes opened by the parent of crik. crik needs to get the same file descriptors in the new
+	// container as well, and they are given to the restored process tree in place of the old ones.
+	InheritedFds []int `json:"inheritedFds,omitempty"`
 
 	// InotifyIncompatiblePaths is the list of paths that are known to cause issues with inotify. We delete those paths
-	// before taking the checkpoint.
+	// before taking the checkpoint, put them back once the dump completes or fails and recreate them in the new
+	// container before restore.
+	// crik detects the watched paths whose file handles cannot be opened and the ones criu fails to open during dump,
+	// so this list is needed only for the paths detection misses.
 	InotifyIncompatiblePaths []string `json:"inotifyIncompatiblePaths,omitempty"`
+
+	// DisableInotifyDetection disables detecting inotify incompatible paths, in which case only
+	// InotifyIncompatiblePaths are deleted.
+	DisableInotifyDetection bool `json:"disableInotifyDetection,omitempty"`
+
+	// Namespaces is the list of namespaces crik creates for the wrapped process. Defaults to ["ipc"] if not set and an
+	// empty list disables all of them. Supported values are "ipc", "pid", "time" and "uts". criu dumps and restores
+	// these namespaces together with the process tree, e.g. the hostname in the UTS namespace is the one captured at
+	// checkpoint time.
+	// If "pid" is given, the process is started in a new PID namespace and restored in a fresh one so that PIDs are
+	// always reproduced exactly without writing to /proc/sys/kernel/ns_last_pid of the host.
+	Namespaces []Namespace `json:"namespaces,omitempty"`
+
+	// ClockContinuity decides the values of CLOCK_MONOTONIC and CLOCK_BOOTTIME after restore when "time" namespace is
+	// used. Either "monotonic", the default, to continue from their values at checkpoint time, or "wall" to advance
+	// them by the wall-clock time that has passed between checkpoint and restore.
+	ClockContinuity ClockContinuity `json:"clockContinuity,omitempty"`
+
+	// NetworkLock is the method used to block the traffic of the pod while the process tree is dumped and restored,
+	// either "nftables" or "iptables". If given, TCP connections are kept established instead of being closed so that
+	// they survive as long as the process is restored with the same IP, e.g. when the dump fails.
+	// If not given, TCP connections are closed during dump.
+	NetworkLock NetworkLockMethod `json:"networkLock,omitempty"`
+
+	// TTY enables running the process tree with a pseudoterminal allocated by crik as its controlling terminal, which
+	// crik relays to its own stdio, e.g. for interactive shells. The terminal is dumped and restored with the shell
+	// job support of criu and Stdio is ignored.
+	TTY bool `json:"tty,omitempty"`
+
+	// Stdio configures how the stdio of the process tree is connected to the stdio of crik. By default, crik relays
+	// the output of the process tree through pipes it owns and stdin of the process tree is /dev/null.
+	Stdio *StdioConfiguration `json:"stdio,omitempty"`
+
+	// Notification enables announcing checkpoint and restore events to the wrapped process. Disabled if not given.
+	Notification *NotificationConfiguration `json:"notification,omitempty"`
 }
 
 // configurationOnDisk contains additional metadata information about the checkpoint that is used during restore.
@@ -72,16 +165,52 @@ type configurationOnDisk struct {
 
 	// UnixFileDescriptors is the list of file descriptors that are opened by all UNIX processes by default.
 	// They map to 0 -> stdin, 1 -> stdout, 2 -> stderr.
-	// In containers, these are connected to either /dev/null or pipes. We need to make sure that when we restore, the
-	// pipes are connected to criu's stdin, stdout, and stderr which is what's connected to the new container's stdin,
+	// In containers, these are connected to either /dev/null or pipes, which are the relay pipes of crik unless the
+	// relay is disabled, see StdioRelay. We need to make sure that when we restore, the pipes are connected to criu's
+	// stdin, stdout, and stderr which are the new relay pipes or what's connected to the new container's stdin,
 	// stdout, and stderr.
 	// This list has only 3 elements in all cases.
 	UnixFileDescriptorTrio []string `json:"unixFileDescriptorTrio,omitempty"`
+
+	// Generation is the number of times the process tree will have been restored once this checkpoint is restored.
+	Generation int `json:"generation,omitempty"`
+
+	// DumpedExternalMounts is the list of mounts marked as external during dump, which need to be given to criu
+	// during restore as well. It has a different key than Configuration.ExternalMounts so that both are kept.
+	DumpedExternalMounts []DirectoryMount `json:"dumpedExternalMounts,omitempty"`
+
+	// PodIPs is the list of addresses of the pod at dump time. When the network is locked, the established TCP
+	// connections are restored only if the pod still has them, i.e. it is restored in place.
+	PodIPs []string `json:"podIPs,omitempty"`
+
+	// CgroupDirs is the list of directories of the cgroups of the process tree keyed by the controllers of their
+	// hierarchy, see CgroupDirs.
+	CgroupDirs map[string]string `json:"cgroupDirs,omitempty"`
+
+	// ExternalUnixConnections is the list of sockets of the process tree connected to ExternalUnixSockets.
+	ExternalUnixConnections []externalUnixConnection `json:"externalUnixConnections,omitempty"`
+
+	// InheritedFdKeys is the list of the targets of InheritedFds during dump.
+	InheritedFdKeys []inheritedFd `json:"inheritedFdKeys,omitempty"`
+
+	// SocketDirs is the list of parent directories of the Unix sockets bound by the process tree.
+	SocketDirs []SocketDir `json:"socketDirs,omitempty"`
+
+	// EmptyDirSnapshots is the list of emptyDir volumes whose contents are in the checkpoint. Only these are put back
+	// during restore in case copies of other volumes are left in a reused image directory.
+	EmptyDirSnapshots []string `json:"emptyDirSnapshots,omitempty"`
+
+	// TTYState is the state of the terminal of the process tree in TTY mode.
+	TTYState *ttyState `json:"ttyState,omitempty"`
+
+	// CheckpointTime is the wall-clock time right before the process tree is frozen.
+	CheckpointTime *time.Time `json:"checkpointTime,omitempty"`
 }
 
 var (
 	// DirectoryMounts is the list of directories that are mounted by the container runtime and need to be marked as
 	// such during checkpoint and restore so that the underlying files can change without breaking the restore process.
+	// They are always marked as external in addition to the ones found by ExternalMounts.
 	DirectoryMounts = []DirectoryMount{
 		{
 			Name:             "zoneinfo",
@@ -127,83 +256,18 @@ type DirectoryMount struct {
 	PathInRestore    string `json:"pathInRestore"`
 }
 
-func GetExternalDirectoriesForCheckpoint() []string {
-	result := make([]string, len(DirectoryMounts))
-	for i, d := range DirectoryMounts {
+func GetExternalDirectoriesForCheckpoint(mounts []DirectoryMount) []string {
+	result := make([]string, len(mounts))
+	for i, d := range mounts {
 		result[i] = fmt.Sprintf("mnt[%s]:%s", d.PathInCheckpoint, d.Name)
 	}
 	return result
 }
 
-func GetExternalDirectoriesForRestore() []string {
-	result := make([]string, len(DirectoryMounts))
-	for i, d := range DirectoryMounts {
+func GetExternalDirectoriesForRestore(mounts []DirectoryMount) []string {
+	result := make([]string, len(mounts))
+	for i, d := range mounts {
 		result[i] = fmt.Sprintf("mnt[%s]:%s", d.Name, d.PathInRestore)
 	}
 	return result
 }
-
-func CopyDir(src, dst string) error {
-	return filepath.WalkDir(src, func(srcPath string, d os.DirEntry, err error) error {
-		// If the file/folder doesn't exist, we don't need to copy it.
-		if os.IsNotExist(err) {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
-		rel, err := filepath.Rel(src, srcPath)
-		if err != nil {
-			return err
-		}
-		dstPath := filepath.Join(dst, rel)
-		if d.IsDir() {
-			return os.MkdirAll(dstPath, d.Type().Perm())
-		}
-		// TODO(muvaf): This changes the perms of folder if the dir wasn't walked before.
-		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-			return err
-		}
-		src, err := os.Open(srcPath)
-		if err != nil {
-			return err
-		}
-		defer src.Close()
-
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
-
-		if _, err := io.Copy(dst, src); err != nil {
-			return err
-		}
-
-		// Get the source file mode to apply to the destination file
-		srcInfo, err := src.Stat()
-		if err != nil {
-			return err
-		}
-		return os.Chmod(dstPath, srcInfo.Mode())
-	})
-}
-
-func GetKubePodFilePaths(imageDir string) (map[string]string, error) {
-	c := crit.New(nil, nil, imageDir, false, false)
-	fds, err := c.ExploreFds()
-	if err != nil {
-		return nil, fmt.Errorf("failed to explore fds: %w", err)
-	}
-	result := map[string]string{}
-	for _, fd := range fds {
-		for _, file := range fd.Files {
-			if !strings.HasPrefix(file.Path, "/sys/fs/cgroup/kubepods.slice") ||
-				file.Type != "REG" {
-				continue
-			}
-			result[filepath.Base(file.Path)] = file.Path
-		}
-	}
-	return result, nil
-}
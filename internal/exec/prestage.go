@@ -0,0 +1,75 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	// ExtraFilesDirName is the directory in the image directory where the files that are not part of the image of the
+	// new container are kept.
+	ExtraFilesDirName = "extraFiles"
+)
+
+// GetCopyWorkers returns the number of files copied in parallel, which is the number of CPUs if not configured.
+func (c Configuration) GetCopyWorkers() int {
+	if c.CopyWorkers > 0 {
+		return c.CopyWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// SyncAdditionalPaths brings the copies of AdditionalPaths in the image directory up to date.
+func SyncAdditionalPaths(cfg Configuration) error {
+	return syncAdditionalPaths(cfg.AdditionalPaths, filepath.Join(cfg.ImageDir, ExtraFilesDirName), cfg.ImageDir,
+		cfg.GetCopyWorkers())
+}
+
+// StartPrestaging copies AdditionalPaths into the image directory periodically in the background so that only the
+// files changed since the last copy need to be copied during dump. The returned function stops the copying and waits
+// for the ongoing one to complete.
+func StartPrestaging(cfg Configuration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(cfg.PrestageIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			start := time.Now()
+			if err := SyncAdditionalPaths(cfg); err != nil {
+				fmt.Printf("failed to pre-stage additional paths: %s\n", err.Error())
+			} else {
+				fmt.Printf("Pre-staged additional paths in %s\n", time.Since(start))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// LastPIDPath is the sysctl that decides the PID of the next process in the PID namespace.
+	LastPIDPath = "/proc/sys/kernel/ns_last_pid"
+)
+
+// Capability is a Linux capability.
+type Capability struct {
+	Name string
+	Bit  uint
+}
+
+// Capabilities crik needs depending on its configuration.
+var (
+	CapSysAdmin          = Capability{Name: "CAP_SYS_ADMIN", Bit: unix.CAP_SYS_ADMIN}
+	CapCheckpointRestore = Capability{Name: "CAP_CHECKPOINT_RESTORE", Bit: unix.CAP_CHECKPOINT_RESTORE}
+	CapSysPtrace         = Capability{Name: "CAP_SYS_PTRACE", Bit: unix.CAP_SYS_PTRACE}
+	CapNetAdmin          = Capability{Name: "CAP_NET_ADMIN", Bit: unix.CAP_NET_ADMIN}
+)
+
+// EffectiveCapabilities returns the effective capability set of crik. The capabilities are relative to the user
+// namespace crik runs in, which is the user namespace of the pod if it has one.
+func EffectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open /proc/self/status: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		v, ok := strings.CutPrefix(s.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse CapEff: %w", err)
+		}
+		return caps, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read /proc/self/status: %w", err)
+	}
+	return 0, fmt.Errorf("CapEff not found in /proc/self/status")
+}
+
+// HasCapability returns true if the capability is in the given set.
+func HasCapability(caps uint64, c Capability) bool {
+	return caps&(1<<c.Bit) != 0
+}
+
+// IsUnprivileged returns true if crik has to run criu in unprivileged mode, i.e. it has CAP_CHECKPOINT_RESTORE
+// but not CAP_SYS_ADMIN.
+func IsUnprivileged() bool {
+	caps, err := EffectiveCapabilities()
+	if err != nil {
+		return false
+	}
+	return HasCapability(caps, CapCheckpointRestore) && !HasCapability(caps, CapSysAdmin)
+}
+
+// InUserNamespace returns true if crik runs in a user namespace other than the initial one, e.g. in a pod with
+// hostUsers set to false.
+func InUserNamespace() bool {
+	b, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(b))
+	return len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+}
+
+// SupportsSetTID returns true if the kernel supports choosing the PID of a new process with clone3, which criu uses
+// instead of writing to /proc/sys/kernel/ns_last_pid. Available since Linux 5.5.
+func SupportsSetTID() bool {
+	return KernelAtLeast(5, 5)
+}
+
+// KernelAtLeast returns true if the running kernel version is at least the given one.
+func KernelAtLeast(wantMajor, wantMinor int) bool {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return false
+	}
+	release := unix.ByteSliceToString(u.Release[:])
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(strings.TrimFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+}
+
+// IsLastPIDWritable returns true if /proc/sys/kernel/ns_last_pid can be written to.
+func IsLastPIDWritable() bool {
+	return unix.Access(LastPIDPath, unix.W_OK) == nil
+}
+
+// CheckPrivileges returns an error listing every capability and sysctl that is missing for the given configuration.
+func CheckPrivileges(cfg Configuration) error {
+	caps, err := EffectiveCapabilities()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	if !HasCapability(caps, CapCheckpointRestore) && !HasCapability(caps, CapSysAdmin) {
+		missing = append(missing, fmt.Sprintf("%s (or %s)", CapCheckpointRestore.Name, CapSysAdmin.Name))
+	}
+	if !HasCapability(caps, CapSysPtrace) {
+		missing = append(missing, CapSysPtrace.Name)
+	}
+	if cfg.NetworkLock != NetworkLockMethodNone && !HasCapability(caps, CapNetAdmin) {
+		missing = append(missing, fmt.Sprintf("%s (required by networkLock)", CapNetAdmin.Name))
+	}
+	namespaces := NamespacesOrDefault(cfg.Namespaces)
+	if len(namespaces) > 0 && !HasCapability(caps, CapSysAdmin) {
+		missing = append(missing, fmt.Sprintf("%s (required to create %v namespaces, set namespaces to [] to disable them)",
+			CapSysAdmin.Name, namespaces))
+	}
+	if !HasNamespace(namespaces, NamespacePID) && !SupportsSetTID() && !IsLastPIDWritable() {
+		missing = append(missing, fmt.Sprintf("write access to %s (or Linux 5.5+ or pid namespace)", LastPIDPath))
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing privileges:\n  - %s", strings.Join(missing, "\n  - "))
+}
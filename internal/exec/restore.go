@@ -22,67 +22,120 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"strconv"
 	"strings"
-	"syscall"
+	"time"
+
+	"github.com/qawolf/crik/pkg/notify"
 )
 
-func RestoreWithCmd(imageDir string) error {
-	if err := os.MkdirAll("/tmp/.X11-unix", 0755); err != nil {
-		return fmt.Errorf("failed to mkdir /tmp/.X11-unix: %w", err)
+// RestoreWithCmd restores the checkpoint in the given image directory with criu. The given configuration is the one of
+// the new pod, which decides how the files of the checkpoint that conflict with the ones in the new container are
+// handled since the configuration in the checkpoint is the one of the old pod.
+func RestoreWithCmd(imageDir string, current Configuration) error {
+	conf, err := readConfigurationOnDisk(imageDir)
+	if err != nil {
+		return err
 	}
-	if err := CopyDir(filepath.Join(imageDir, "extraFiles"), "/"); err != nil {
-		return fmt.Errorf("failed to copy extra files: %w", err)
+	if err := RecreateSocketDirs(imageDir, conf.SocketDirs); err != nil {
+		return fmt.Errorf("failed to create parent directories of Unix sockets: %w", err)
+	}
+	report, err := ReplayCheckpointFiles(imageDir, current)
+	report.Print(os.Stdout)
+	if err != nil {
+		return err
 	}
 	args := []string{"restore",
 		"--images-dir", imageDir,
 		"--tcp-established",
 		"--file-locks",
 		"--evasive-devices",
-		"--tcp-close",
 		"--manage-cgroups=ignore",
 		"-v4",
 		"--log-file", "restore.log",
 	}
-	configYAML, err := os.ReadFile(filepath.Join(imageDir, ConfigurationFileName))
-	if err != nil {
-		return fmt.Errorf("failed to read stdio file descriptors: %w", err)
+	if IsUnprivileged() {
+		args = append(args, "--unprivileged")
 	}
-	conf := &configurationOnDisk{}
-	if err := yaml.Unmarshal(configYAML, conf); err != nil {
-		return fmt.Errorf("failed to unmarshal stdio file descriptors: %w", err)
+	if conf.ClockContinuity == ClockContinuityWall && conf.CheckpointTime != nil {
+		if err := AdvanceTimeNamespaces(imageDir, time.Since(*conf.CheckpointTime)); err != nil {
+			return fmt.Errorf("failed to advance clocks: %w", err)
+		}
+	}
+	mounts := conf.DumpedExternalMounts
+	if mounts == nil {
+		// Checkpoints taken by older versions of crik.
+		mounts = DirectoryMounts
 	}
-	for _, d := range GetExternalDirectoriesForRestore() {
+	if err := checkExternalMounts(mounts); err != nil {
+		return err
+	}
+	for _, d := range GetExternalDirectoriesForRestore(mounts) {
 		args = append(args, "--external", d)
 	}
-	inheritedFds := conf.UnixFileDescriptorTrio
-
-	// When cgroup v2 is used, the path to resource usage files contain pod and container IDs which are changed
-	// in the new pod. We find and replace them with the new files.
-	kubePodFiles, err := GetKubePodFilePaths(imageDir)
-	if err != nil {
-		return fmt.Errorf("failed to get kubepods.slice files: %w", err)
+	if conf.NetworkLock == NetworkLockMethodNone {
+		args = append(args, "--tcp-close")
+	} else {
+		if !sameIPs(conf.PodIPs) {
+			// The connections were dumped as established but their local addresses are gone, e.g. the pod is
+			// restored on another node, so they can only be restored closed.
+			args = append(args, "--tcp-close")
+		}
+		// The network stays locked until the process tree is resumed, see RunActionScript.
+		args = append(args, "--network-lock", "skip")
+		l, err := NewNetworkLocker(conf.NetworkLock)
+		if err != nil {
+			return err
+		}
+		if err := l.Lock(); err != nil {
+			return fmt.Errorf("failed to lock network: %w", err)
+		}
+		defer l.Unlock() //nolint:errcheck // Unlocking is idempotent and the action script reports the errors.
 	}
-	var extraFiles []*os.File
-	if len(kubePodFiles) > 0 {
-		// All processes within container are in the same cgroup, so getting the folder of self is enough.
-		str, err := os.ReadFile("/proc/self/cgroup")
+	if conf.Notification != nil || conf.NetworkLock != NetworkLockMethodNone {
+		// criu runs action scripts with "sh -c", so crik calls itself to act once the process tree is resumed.
+		exe, err := os.Executable()
 		if err != nil {
-			return fmt.Errorf("failed to read /proc/self/cgroup: %w", err)
+			return fmt.Errorf("failed to get path of crik executable: %w", err)
 		}
-		basePath := filepath.Join("/sys/fs/cgroup", strings.Split(strings.Split(string(str), "\n")[0], ":")[2])
-		for k, v := range kubePodFiles {
-			path := filepath.Join(basePath, k)
-			f, err := os.OpenFile(path, syscall.O_RDONLY, 0)
-			if err != nil {
-				return fmt.Errorf("failed to open %s: %w", k, err)
-			}
-			// The index of file descriptor in extraFiles must match the index+3 in inheritedFds because
-			// the first 3 file descriptors are reserved for stdin, stdout, and stderr.
-			inheritedFds = append(inheritedFds, strings.TrimPrefix(v, "/"))
-			extraFiles = append(extraFiles, f)
+		args = append(args, "--action-script", fmt.Sprintf("%s action-script", shellQuote(exe)))
+	}
+	inheritedFds := conf.UnixFileDescriptorTrio
+	if conf.TTY {
+		if conf.TTYState == nil {
+			return fmt.Errorf("terminal of the process tree is not recorded in the checkpoint")
 		}
+		// criu gets the new terminal as its stdin and gives it to the process tree in place of the old one.
+		inheritedFds = []string{conf.TTYState.Key, "", ""}
+		args = append(args, "--shell-job")
+	}
+
+	// The paths of cgroup files contain the IDs of the pod and the container, which are changed in the new pod. We
+	// open the same files in the cgroups of the new container and pass them to criu.
+	cgroupFiles, extraFiles, err := CgroupInheritedFiles(imageDir, conf.CgroupDirs)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup files: %w", err)
+	}
+	// The index of file descriptor in extraFiles must match the index+3 in inheritedFds because the first 3 file
+	// descriptors are reserved for stdin, stdout, and stderr.
+	inheritedFds = append(inheritedFds, cgroupFiles...)
+	// Connections to external Unix sockets are made anew and the inherited file descriptors are the ones of crik.
+	externalKeys, externalFiles, err := ExternalInheritedFiles(conf.ExternalUnixConnections, conf.InheritedFdKeys)
+	if err != nil {
+		return fmt.Errorf("failed to prepare external file descriptors: %w", err)
+	}
+	inheritedFds = append(inheritedFds, externalKeys...)
+	extraFiles = append(extraFiles, externalFiles...)
+	if len(conf.ExternalUnixConnections) > 0 {
+		args = append(args, "--ext-unix-sk")
+	}
+	if err := RemapCgroupWatches(imageDir, conf.CgroupDirs); err != nil {
+		return fmt.Errorf("failed to remap inotify watches on cgroup files: %w", err)
 	}
 	for i, fdStr := range inheritedFds {
+		if fdStr == "" {
+			continue
+		}
 		args = append(args, "--inherit-fd", fmt.Sprintf("fd[%d]:%s", i, fdStr))
 	}
 	cmd := exec.Command("criu", args...)
@@ -90,5 +143,87 @@ func RestoreWithCmd(imageDir string) error {
 	cmd.Stdin = nil
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if conf.TTY {
+		pty, err := OpenPty()
+		if err != nil {
+			return err
+		}
+		defer pty.Close()
+		if err := pty.SetTermios(conf.TTYState.Termios); err != nil {
+			return fmt.Errorf("failed to configure terminal: %w", err)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = pty.Slave, pty.Slave, pty.Slave
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to start criu: %w", err)
+		}
+		pty.Start()
+		err = cmd.Wait()
+		pty.Wait()
+		return err
+	}
+	// criu passes its own stdio to the restored process tree in place of the recorded ones, see
+	// UnixFileDescriptorTrio, so it gets new relay pipes.
+	relay, err := NewStdioRelay(conf.Stdio)
+	if err != nil {
+		return err
+	}
+	if relay == nil {
+		return cmd.Run()
+	}
+	defer relay.Close()
+	relay.Attach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start criu: %w", err)
+	}
+	relay.Start()
+	err = cmd.Wait()
+	relay.Wait()
+	return err
+}
+
+// RunActionScript is called by criu as an action script during restore. Once the process tree is resumed, it releases
+// the network lock and announces the restore to the root of the restored process tree.
+// See https://criu.org/Action_scripts for the environment variables criu provides.
+func RunActionScript() error {
+	if os.Getenv("CRTOOLS_SCRIPT_ACTION") != "post-resume" {
+		return nil
+	}
+	imageDir := os.Getenv("CRTOOLS_IMAGE_DIR")
+	conf, err := readConfigurationOnDisk(imageDir)
+	if err != nil {
+		return err
+	}
+	l, err := NewNetworkLocker(conf.NetworkLock)
+	if err != nil {
+		return err
+	}
+	if err := l.Unlock(); err != nil {
+		return fmt.Errorf("failed to unlock network: %w", err)
+	}
+	if conf.Notification == nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(os.Getenv("CRTOOLS_INIT_PID"))
+	if err != nil {
+		return fmt.Errorf("failed to parse CRTOOLS_INIT_PID: %w", err)
+	}
+	return conf.Notification.Notify(pid, notify.EventRestored, conf.Generation)
+}
+
+// readConfigurationOnDisk reads the configuration with the metadata of the checkpoint in the image directory.
+func readConfigurationOnDisk(imageDir string) (*configurationOnDisk, error) {
+	configYAML, err := os.ReadFile(filepath.Join(imageDir, ConfigurationFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration in image directory: %w", err)
+	}
+	conf := &configurationOnDisk{}
+	if err := yaml.Unmarshal(configYAML, conf); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal configuration in image directory: %w", err)
+	}
+	return conf, nil
+}
+
+// shellQuote quotes the given string for sh so that it's passed as a single word as is.
+func shellQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
 }
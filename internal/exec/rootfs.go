@@ -0,0 +1,543 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// RootfsDiffFileName is the tar archive of the files added or modified in the container's writable layer.
+	RootfsDiffFileName = "rootfs-diff.tar"
+
+	// RootfsDeletedFileName lists the files deleted from the container's image, one path per line.
+	RootfsDeletedFileName = "deleted.files"
+
+	// RootfsOpaqueFileName lists the directories that were deleted and recreated in the container, one path per line.
+	// Their contents in the image are replaced by the ones in the rootfs diff as a whole.
+	RootfsOpaqueFileName = "opaque.dirs"
+
+	// RootfsBaselineFileName lists the files of the root filesystem when crik started. It is used to find the
+	// deleted files when the upper directory of the overlay filesystem is not accessible.
+	RootfsBaselineFileName = "rootfs-baseline.files"
+)
+
+// walkRootfs calls fn for every path on the root filesystem of the container, skipping other filesystems mounted on
+// it and the given directories.
+func walkRootfs(skip []string, fn func(p string, st *unix.Stat_t) error) error {
+	var root unix.Stat_t
+	if err := unix.Stat("/", &root); err != nil {
+		return fmt.Errorf("failed to stat root filesystem: %w", err)
+	}
+	// SkipDir for a file skips the rest of its directory, so it's returned only for directories.
+	skipDir := func(d fs.DirEntry) error {
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	return filepath.WalkDir("/", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed during the walk.
+			return nil
+		}
+		for _, s := range skip {
+			if p == s {
+				return skipDir(d)
+			}
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return nil
+		}
+		if st.Dev != root.Dev {
+			// Another filesystem is mounted here, e.g. a volume or a bind-mounted /etc/hosts.
+			return skipDir(d)
+		}
+		if p == "/" {
+			return nil
+		}
+		return fn(p, &st)
+	})
+}
+
+// WriteRootfsBaseline records the paths on the root filesystem so that the deleted ones can be found at checkpoint
+// time. It does nothing if the upper directory of the overlay filesystem is accessible.
+func WriteRootfsBaseline(imageDir string) error {
+	if rootUpperDir() != "" {
+		return nil
+	}
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create image directory: %w", err)
+	}
+	f, err := os.Create(filepath.Join(imageDir, RootfsBaselineFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create rootfs baseline: %w", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := walkRootfs([]string{imageDir}, func(p string, _ *unix.Stat_t) error {
+		_, err := w.WriteString(p + "\n")
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to walk root filesystem: %w", err)
+	}
+	return w.Flush()
+}
+
+// WriteRootfsDiff archives the files added or modified in the writable layer of the container and lists the deleted
+// ones, similar to the rootfs-diff.tar of CRI-O checkpoints.
+// If the upper directory of the overlay filesystem is accessible, it is used as is. Otherwise, the files changed
+// after the container started are archived and the deleted ones are found by comparing the root filesystem with the
+// baseline written by WriteRootfsBaseline.
+func WriteRootfsDiff(imageDir string) error {
+	var changed, deleted, opaque []string
+	if upper := rootUpperDir(); upper != "" {
+		var err error
+		if changed, deleted, opaque, err = diffFromUpperDir(upper, imageDir); err != nil {
+			return err
+		}
+	} else {
+		started, err := ContainerStartTime()
+		if err != nil {
+			return err
+		}
+		existing := map[string]bool{}
+		if err := walkRootfs([]string{imageDir}, func(p string, st *unix.Stat_t) error {
+			existing[p] = true
+			if time.Unix(st.Ctim.Unix()).After(started) {
+				changed = append(changed, p)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to walk root filesystem: %w", err)
+		}
+		baseline, err := os.ReadFile(filepath.Join(imageDir, RootfsBaselineFileName))
+		if err != nil {
+			return fmt.Errorf("failed to read rootfs baseline: %w", err)
+		}
+		for _, p := range strings.Split(string(baseline), "\n") {
+			if p != "" && !existing[p] {
+				deleted = append(deleted, p)
+			}
+		}
+	}
+	if err := writeTar(filepath.Join(imageDir, RootfsDiffFileName), changed); err != nil {
+		return fmt.Errorf("failed to write rootfs diff: %w", err)
+	}
+	content := strings.Join(deleted, "\n")
+	if err := os.WriteFile(filepath.Join(imageDir, RootfsDeletedFileName), []byte(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write deleted files: %w", err)
+	}
+	content = strings.Join(opaque, "\n")
+	if err := os.WriteFile(filepath.Join(imageDir, RootfsOpaqueFileName), []byte(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write opaque directories: %w", err)
+	}
+	return nil
+}
+
+// diffFromUpperDir returns the changed, deleted and opaque paths in the given overlay upper directory, skipping the
+// image directory. Deleted files are represented as whiteouts, i.e. character devices with 0/0 device number, and
+// directories that were deleted and recreated are marked opaque so that the entries of the lower layers are hidden.
+func diffFromUpperDir(upper, imageDir string) ([]string, []string, []string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// The container runtime creates stubs in the upper directory for the files and directories it bind mounts, e.g.
+	// /etc/hosts, which belong to the mounts of the new pod instead.
+	mountPoints := map[string]bool{}
+	for _, m := range mounts {
+		if m.MountPoint != "/" {
+			mountPoints[m.MountPoint] = true
+		}
+	}
+	var changed, deleted, opaque []string
+	err = filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return err
+		}
+		path := filepath.Join("/", rel)
+		if path == imageDir || mountPoints[path] {
+			// SkipDir for a file skips the rest of its directory.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0 {
+			deleted = append(deleted, path)
+			return nil
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFDIR && isOpaqueDir(p) {
+			opaque = append(opaque, path)
+		}
+		changed = append(changed, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to walk upper directory: %w", err)
+	}
+	return changed, deleted, opaque, nil
+}
+
+// isOpaqueDir returns true if the directory in an overlay upper directory is opaque. Overlay mounts with the userxattr
+// option, e.g. in user namespaces, use the user.* namespace instead of trusted.*.
+func isOpaqueDir(p string) bool {
+	buf := make([]byte, 1)
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if n, err := unix.Lgetxattr(p, name, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTar archives the given paths of the root filesystem keeping their metadata.
+func writeTar(dst string, paths []string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	// Files with several links are archived once and the other links refer to the first one.
+	type inode struct{ dev, ino uint64 }
+	linked := map[inode]string{}
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to create header for %s: %w", p, err)
+		}
+		hdr.Name = strings.TrimPrefix(p, "/")
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := linked[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				continue
+			}
+			linked[key] = hdr.Name
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFileTo(tw, p); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", p, err)
+		}
+	}
+	return tw.Close()
+}
+
+func copyFileTo(w io.Writer, p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// applyRootfsDiff replays the rootfs diff in the given image directory onto the root filesystem, if there is one,
+// applying the conflict policies to the files that exist in the new container.
+func applyRootfsDiff(imageDir string, r *conflictResolver) error {
+	f, err := os.Open(filepath.Join(imageDir, RootfsDiffFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	deleted, err := os.ReadFile(filepath.Join(imageDir, RootfsDeletedFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read deleted files: %w", err)
+	}
+	for _, p := range strings.Split(string(deleted), "\n") {
+		if p == "" {
+			continue
+		}
+		remove, err := r.resolveDeletion(p)
+		if err != nil {
+			return err
+		}
+		if !remove {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p, err)
+		}
+	}
+	if err := clearOpaqueDirs(imageDir, f, r); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read rootfs diff: %w", err)
+		}
+		p := filepath.Join("/", hdr.Name)
+		if err := extractWithPolicy(tr, hdr, p, r); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", p, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+	// Creating files in directories changes their modification time, so they are set at the end.
+	for _, hdr := range dirs {
+		p := filepath.Join("/", hdr.Name)
+		if err := os.Chtimes(p, hdr.AccessTime, hdr.ModTime); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to set times of %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// clearOpaqueDirs removes the entries of the opaque directories in the new container that are not in the rootfs diff
+// given as a tar archive, so that the directories have only the contents they had in the checkpointed container.
+func clearOpaqueDirs(imageDir string, archive io.Reader, r *conflictResolver) error {
+	b, err := os.ReadFile(filepath.Join(imageDir, RootfsOpaqueFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read opaque directories: %w", err)
+	}
+	var opaque []string
+	for _, p := range strings.Split(string(b), "\n") {
+		if p != "" {
+			opaque = append(opaque, p)
+		}
+	}
+	if len(opaque) == 0 {
+		return nil
+	}
+	inDiff := map[string]bool{}
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read rootfs diff: %w", err)
+		}
+		inDiff[filepath.Join("/", hdr.Name)] = true
+	}
+	for _, dir := range opaque {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if inDiff[p] {
+				continue
+			}
+			remove, err := r.resolveDeletion(p)
+			if err != nil {
+				return err
+			}
+			if !remove {
+				continue
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// extractWithPolicy extracts the entry to the given path. If something exists there, the entry is extracted next to
+// it first so that it can be compared and the conflict policy decides which one is kept.
+func extractWithPolicy(tr io.Reader, hdr *tar.Header, p string, r *conflictResolver) error {
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		r.written[p] = true
+		return extractTarEntry(tr, hdr, p)
+	}
+	if err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if isDirOrLinkToDir(p, fi) {
+			return extractTarEntry(tr, hdr, p)
+		}
+		replace, err := r.resolve("", p, &unix.Stat_t{Mode: unix.S_IFDIR})
+		if err != nil || !replace {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		r.written[p] = true
+		return extractTarEntry(tr, hdr, p)
+	case tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		tmp := filepath.Join(filepath.Dir(p), ".crik-"+filepath.Base(p))
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+		if err := extractTarEntry(tr, hdr, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(tmp, &st); err != nil {
+			return err
+		}
+		replace, err := r.resolve(tmp, p, &st)
+		if err != nil || !replace {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if fi.IsDir() {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+		r.written[p] = true
+		return os.Rename(tmp, p)
+	default:
+		return extractTarEntry(tr, hdr, p)
+	}
+}
+
+func extractTarEntry(r io.Reader, hdr *tar.Header, p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(p, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, p); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		// The metadata is the one of the file linked to, which is extracted before.
+		return os.Link(filepath.Join("/", hdr.Linkname), p)
+	case tar.TypeReg:
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	default:
+		// Devices, FIFOs and sockets are recreated by criu if the process tree has them open.
+		return nil
+	}
+	if err := unix.Lchown(p, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EINVAL) {
+		// Like in applyMetadata, the file is owned by crik's user if it cannot change the owner.
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// Chmod is needed since umask applies on creation and to set setuid and similar bits.
+	if err := os.Chmod(p, os.FileMode(hdr.Mode)&os.ModePerm|tarSpecialBits(hdr.Mode)); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return os.Chtimes(p, hdr.AccessTime, hdr.ModTime)
+}
+
+// tarSpecialBits converts setuid, setgid and sticky bits of a tar header mode to os.FileMode.
+func tarSpecialBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/sock_diag.h and linux/unix_diag.h.
+const (
+	sockDiagByFamily = 20
+	udiagShowName    = 0x1
+	udiagShowPeer    = 0x4
+	unixDiagName     = 0
+	unixDiagPeer     = 2
+	unixDiagReqSize  = 24
+	unixDiagMsgSize  = 16
+)
+
+// UnixSocket is a Unix socket in the network namespace of crik.
+type UnixSocket struct {
+	Inode uint32
+	// Type is SOCK_STREAM, SOCK_DGRAM or SOCK_SEQPACKET.
+	Type uint8
+	// State is the TCP-like state of the socket, e.g. 1 for established and 10 for listening.
+	State uint8
+	// Name is the path the socket is bound to. Abstract names start with "@".
+	Name string
+	// Peer is the inode of the socket on the other end, zero if not connected.
+	Peer uint32
+}
+
+// ListUnixSockets returns all Unix sockets in the network namespace of crik keyed by their inode, using the sock_diag
+// netlink interface which, unlike /proc/net/unix, reports the peer of connected sockets.
+func ListUnixSockets() (map[uint32]UnixSocket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sock_diag socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	req := make([]byte, unix.SizeofNlMsghdr+unixDiagReqSize)
+	binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:6], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	body := req[unix.SizeofNlMsghdr:]
+	body[0] = unix.AF_UNIX
+	binary.NativeEndian.PutUint32(body[4:8], 0xffffffff) // All states.
+	binary.NativeEndian.PutUint32(body[12:16], udiagShowName|udiagShowPeer)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to send sock_diag request: %w", err)
+	}
+
+	result := map[uint32]UnixSocket{}
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive sock_diag response: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sock_diag response: %w", err)
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return result, nil
+			case unix.NLMSG_ERROR:
+				return nil, fmt.Errorf("sock_diag returned an error")
+			}
+			s, ok := parseUnixDiagMsg(m.Data)
+			if !ok {
+				continue
+			}
+			result[s.Inode] = s
+		}
+	}
+}
+
+// parseUnixDiagMsg parses the payload of a sock_diag response message, i.e. a unix_diag_msg followed by its attributes.
+// It returns false if the message is too short. Malformed attributes are ignored.
+func parseUnixDiagMsg(data []byte) (UnixSocket, bool) {
+	if len(data) < unixDiagMsgSize {
+		return UnixSocket{}, false
+	}
+	s := UnixSocket{
+		Type:  data[1],
+		State: data[2],
+		Inode: binary.NativeEndian.Uint32(data[4:8]),
+	}
+	attrs := data[unixDiagMsgSize:]
+	for len(attrs) >= 4 {
+		l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		if l < 4 || l > len(attrs) {
+			break
+		}
+		v := attrs[4:l]
+		switch binary.NativeEndian.Uint16(attrs[2:4]) {
+		case unixDiagName:
+			s.Name = string(v)
+			if len(v) > 0 && v[0] == 0 {
+				s.Name = "@" + string(v[1:])
+			}
+		case unixDiagPeer:
+			if len(v) >= 4 {
+				s.Peer = binary.NativeEndian.Uint32(v[0:4])
+			}
+		}
+		aligned := (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(attrs) {
+			break
+		}
+		attrs = attrs[aligned:]
+	}
+	return s, true
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+// unixDiagMsg builds a unix_diag_msg with the given attributes appended as is.
+func unixDiagMsg(typ, state uint8, inode uint32, attrs ...[]byte) []byte {
+	b := make([]byte, unixDiagMsgSize)
+	b[0] = syscall.AF_UNIX
+	b[1], b[2] = typ, state
+	binary.NativeEndian.PutUint32(b[4:8], inode)
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	return b
+}
+
+// unixDiagAttr builds an attribute padded to 4 bytes.
+func unixDiagAttr(typ uint16, v []byte) []byte {
+	b := make([]byte, 4, 4+len(v)+3)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(4+len(v)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, v...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func peerAttr(inode uint32) []byte {
+	v := make([]byte, 4)
+	binary.NativeEndian.PutUint32(v, inode)
+	return unixDiagAttr(unixDiagPeer, v)
+}
+
+func TestParseUnixDiagMsg(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		want   UnixSocket
+		wantOK bool
+	}{
+		{
+			name: "too short",
+			data: make([]byte, unixDiagMsgSize-1),
+		},
+		{
+			name:   "no attributes",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 10, 42),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 10},
+			wantOK: true,
+		},
+		{
+			name:   "path name and peer",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, unixDiagAttr(unixDiagName, []byte("/run/a.sock")), peerAttr(43)),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1, Name: "/run/a.sock", Peer: 43},
+			wantOK: true,
+		},
+		{
+			name:   "abstract name",
+			data:   unixDiagMsg(syscall.SOCK_DGRAM, 7, 42, unixDiagAttr(unixDiagName, []byte("\x00abstract"))),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_DGRAM, State: 7, Name: "@abstract"},
+			wantOK: true,
+		},
+		{
+			name:   "unknown attribute is skipped",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, unixDiagAttr(5, []byte{1, 2, 3}), peerAttr(43)),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1, Peer: 43},
+			wantOK: true,
+		},
+		{
+			name:   "short peer is ignored",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, unixDiagAttr(unixDiagPeer, []byte{1, 2})),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1},
+			wantOK: true,
+		},
+		{
+			name:   "truncated attribute stops parsing",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, peerAttr(43), unixDiagAttr(unixDiagName, []byte("/run/a.sock"))[:8]),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1, Peer: 43},
+			wantOK: true,
+		},
+		{
+			name:   "attribute shorter than its header stops parsing",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, []byte{2, 0, 0, 0}, peerAttr(43)),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1},
+			wantOK: true,
+		},
+		{
+			name:   "unpadded last attribute",
+			data:   unixDiagMsg(syscall.SOCK_STREAM, 1, 42, unixDiagAttr(unixDiagName, []byte("/a"))[:6]),
+			want:   UnixSocket{Inode: 42, Type: syscall.SOCK_STREAM, State: 1, Name: "/a"},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseUnixDiagMsg(tt.data)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseUnixDiagMsg() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRelayLineLength is the length of the longest line relayed as is when lines are prefixed or written as JSON.
+	maxRelayLineLength = 64 * 1024
+)
+
+// StdioFormat is the format of the lines relayed from the output of the process tree.
+type StdioFormat string
+
+const (
+	// StdioFormatRaw relays the output as is, with Prefix prepended to every line if given. It is the default.
+	StdioFormatRaw StdioFormat = "raw"
+	// StdioFormatJSON writes every line as a JSON object with "time", "stream" and "log" fields, plus "prefix" if
+	// Prefix is given.
+	StdioFormatJSON StdioFormat = "json"
+)
+
+// StdioConfiguration configures how the stdio of the process tree is connected to the stdio of crik.
+type StdioConfiguration struct {
+	// DisableRelay connects the stdio of crik directly to the process tree instead of through pipes owned by crik,
+	// in which case the process tree can only be restored if stdio of crik in the new container is the same kind of
+	// file as in the old one.
+	DisableRelay bool `json:"disableRelay,omitempty"`
+
+	// Stdin enables relaying stdin of crik to the process tree. If not given, stdin of the process tree is
+	// /dev/null.
+	Stdin bool `json:"stdin,omitempty"`
+
+	// Prefix is prepended to every line of the output.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Format is either "raw", the default, or "json".
+	Format StdioFormat `json:"format,omitempty"`
+}
+
+// StdioRelay owns the pipes connected to the stdio of the process tree and relays them to the stdio of crik. The
+// pipes are recorded as external during dump and new ones are given to criu in their place during restore, so the
+// restored process tree is always reattached to crik regardless of what stdio of crik is connected to.
+type StdioRelay struct {
+	cfg StdioConfiguration
+	// child is the ends of the pipes given to the process tree, nil for stdin if it's not relayed.
+	child [3]*os.File
+	// parent is the ends of the pipes kept by crik.
+	parent [3]*os.File
+	wg     sync.WaitGroup
+	// mu serializes the lines of stdout and stderr written to the same destination.
+	mu sync.Mutex
+}
+
+// NewStdioRelay creates the pipes for the stdio of the process tree. It returns nil if relaying is disabled.
+func NewStdioRelay(cfg *StdioConfiguration) (*StdioRelay, error) {
+	r := &StdioRelay{}
+	if cfg != nil {
+		r.cfg = *cfg
+	}
+	if r.cfg.DisableRelay {
+		return nil, nil
+	}
+	for i := 0; i < 3; i++ {
+		if i == 0 && !r.cfg.Stdin {
+			continue
+		}
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create pipe: %w", err)
+		}
+		if i == 0 {
+			r.child[i], r.parent[i] = pr, pw
+		} else {
+			r.child[i], r.parent[i] = pw, pr
+		}
+	}
+	return r, nil
+}
+
+// Attach sets the stdio of the given command to the ends of the pipes of the process tree.
+func (r *StdioRelay) Attach(cmd *exec.Cmd) {
+	// Nil interfaces make exec use /dev/null instead of a typed nil.
+	cmd.Stdin = nil
+	if r.child[0] != nil {
+		cmd.Stdin = r.child[0]
+	}
+	cmd.Stdout = r.child[1]
+	cmd.Stderr = r.child[2]
+}
+
+// Start closes the ends of the pipes given to the command, which must have been started, and starts relaying.
+func (r *StdioRelay) Start() {
+	for i, f := range r.child {
+		if f != nil {
+			f.Close()
+			r.child[i] = nil
+		}
+	}
+	if r.parent[0] != nil {
+		// The goroutine owns the pipe from now on and is not waited for since it may block on reading stdin of crik
+		// forever. It exits once stdin of crik is closed, in which case the process tree sees EOF, or the process
+		// tree has exited and writing to the pipe fails.
+		stdin := r.parent[0]
+		r.parent[0] = nil
+		go func() {
+			_, _ = io.Copy(stdin, os.Stdin)
+			stdin.Close()
+		}()
+	}
+	r.wg.Add(2)
+	go r.relay(r.parent[1], os.Stdout, "stdout")
+	go r.relay(r.parent[2], os.Stderr, "stderr")
+}
+
+// Wait waits until the output is relayed completely, i.e. every process holding the pipes has exited.
+func (r *StdioRelay) Wait() {
+	r.wg.Wait()
+}
+
+// Close closes all the pipes.
+func (r *StdioRelay) Close() {
+	for _, f := range append(r.child[:], r.parent[:]...) {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func (r *StdioRelay) relay(src io.ReadCloser, dst io.Writer, stream string) {
+	defer r.wg.Done()
+	defer src.Close()
+	if r.cfg.Prefix == "" && r.cfg.Format != StdioFormatJSON {
+		_, _ = io.Copy(dst, src)
+		return
+	}
+	br := bufio.NewReaderSize(src, maxRelayLineLength)
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			line := string(chunk)
+			if err == bufio.ErrBufferFull {
+				// Lines longer than the limit are split so that the memory used by the relay is bounded.
+				line += "\n"
+			}
+			r.writeLine(dst, stream, line)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+func (r *StdioRelay) writeLine(dst io.Writer, stream, line string) {
+	var out []byte
+	if r.cfg.Format == StdioFormatJSON {
+		entry := struct {
+			Time   time.Time `json:"time"`
+			Stream string    `json:"stream"`
+			Prefix string    `json:"prefix,omitempty"`
+			Log    string    `json:"log"`
+		}{Time: time.Now(), Stream: stream, Prefix: r.cfg.Prefix, Log: strings.TrimSuffix(line, "\n")}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		out = append(b, '\n')
+	} else {
+		out = []byte(r.cfg.Prefix + line)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = dst.Write(out)
+}
@@ -0,0 +1,397 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	// maxRestartDelay is the upper limit of the delay before a process is restarted, which doubles every time it
+	// exits shortly after it's started.
+	maxRestartDelay = 30 * time.Second
+
+	// stableRunDuration is how long a process needs to run for its restart delay to be reset.
+	stableRunDuration = 10 * time.Second
+)
+
+// RestartPolicy decides whether a process of the manifest is started again once it exits.
+type RestartPolicy string
+
+const (
+	// RestartPolicyNever never restarts the process. It is the default.
+	RestartPolicyNever RestartPolicy = "never"
+	// RestartPolicyOnFailure restarts the process if it exits with a non-zero code or is killed by a signal.
+	RestartPolicyOnFailure RestartPolicy = "on-failure"
+	// RestartPolicyAlways restarts the process whenever it exits.
+	RestartPolicyAlways RestartPolicy = "always"
+)
+
+// ProcessManifest is the list of processes crik runs together, e.g. Xvfb and a browser, as children of a supervisor
+// process so that they are checkpointed and restored as one process tree. The supervisor keeps running in the restored
+// tree, so dependencies and restart policies keep working after restore.
+type ProcessManifest struct {
+	Processes []ProcessSpec `json:"processes"`
+}
+
+// ProcessSpec is a process of the manifest.
+type ProcessSpec struct {
+	// Name is the unique name of the process that other processes refer to in DependsOn.
+	Name string `json:"name"`
+
+	// Command is the command and its arguments.
+	Command []string `json:"command"`
+
+	// Env is the list of environment variables in KEY=VALUE form added to the ones of crik.
+	Env []string `json:"env,omitempty"`
+
+	// Dir is the working directory of the process. Defaults to the one of crik.
+	Dir string `json:"dir,omitempty"`
+
+	// DependsOn is the list of names of the processes that need to be ready before this one is started.
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// ReadyPath is the path that exists once the process is ready to be used by the processes that depend on it,
+	// e.g. /tmp/.X11-unix/X99 for Xvfb. If not given, the process is ready once it's started.
+	ReadyPath string `json:"readyPath,omitempty"`
+
+	// RestartPolicy is either "never", the default, "on-failure" or "always".
+	RestartPolicy RestartPolicy `json:"restartPolicy,omitempty"`
+}
+
+// ReadProcessManifest reads and validates the process manifest in the given file.
+func ReadProcessManifest(path string) (ProcessManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ProcessManifest{}, fmt.Errorf("failed to read process manifest: %w", err)
+	}
+	var m ProcessManifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return ProcessManifest{}, fmt.Errorf("failed to unmarshal process manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return ProcessManifest{}, fmt.Errorf("invalid process manifest: %w", err)
+	}
+	return m, nil
+}
+
+func (m ProcessManifest) validate() error {
+	if len(m.Processes) == 0 {
+		return fmt.Errorf("at least one process is required")
+	}
+	names := map[string]bool{}
+	for _, p := range m.Processes {
+		if p.Name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("process %s is given more than once", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Command) == 0 {
+			return fmt.Errorf("command of %s is required", p.Name)
+		}
+		switch p.RestartPolicy {
+		case "", RestartPolicyNever, RestartPolicyOnFailure, RestartPolicyAlways:
+		default:
+			return fmt.Errorf("unknown restart policy %q of %s", p.RestartPolicy, p.Name)
+		}
+	}
+	for _, p := range m.Processes {
+		for _, d := range p.DependsOn {
+			if !names[d] {
+				return fmt.Errorf("%s depends on unknown process %s", p.Name, d)
+			}
+		}
+	}
+	// Depth-first search for cycles, which would keep the processes in them from ever starting.
+	byName := map[string]ProcessSpec{}
+	for _, p := range m.Processes {
+		byName[p.Name] = p
+	}
+	state := map[string]int{} // 1 is visiting, 2 is done.
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle through %s", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, d := range byName[name].DependsOn {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, p := range m.Processes {
+		if err := visit(p.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervisedProcess is the state of a process of the manifest in the supervisor.
+type supervisedProcess struct {
+	spec ProcessSpec
+	pid  int
+	// started is when the current run started.
+	started time.Time
+	// ready is true once the process has been ready since it was started for the first time.
+	ready bool
+	// finished is true once the process has exited and will not be started again.
+	finished bool
+	// restarting is true while the process waits for its restart delay.
+	restarting bool
+	delay      time.Duration
+}
+
+var (
+	// forwardedSignals are the signals the supervisor and the init process forward to their processes.
+	forwardedSignals = []os.Signal{
+		syscall.SIGTERM,
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+	}
+	// discardedSignals are terminal, job control and pipe signals that concern the supervisor or the init process
+	// itself. They are caught rather than ignored so that it is not stopped or killed by them while its processes,
+	// which inherit ignored signals but not handled ones, keep the default dispositions.
+	discardedSignals = []os.Signal{
+		syscall.SIGHUP,
+		syscall.SIGPIPE,
+		syscall.SIGTSTP,
+		syscall.SIGTTIN,
+		syscall.SIGTTOU,
+		syscall.SIGWINCH,
+	}
+)
+
+// ExitCodeError is returned by RunSupervisor and RunInit when a process failed for good so that crik exits with its
+// exit code.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e ExitCodeError) Error() string {
+	return fmt.Sprintf("a process exited with code %d", e.Code)
+}
+
+// RunSupervisor runs the processes of the manifest in the session of the calling process, starting each once the
+// ones it depends on are ready and restarting them according to their restart policies. It forwards the signals in
+// forwardedSignals to all processes and returns once none of them is running or going to be started again,
+// with the exit code of the first process that failed for good, if any, as ExitCodeError.
+// The supervisor becomes the subreaper of the processes so that their orphaned children stay in the process tree
+// that is checkpointed.
+func RunSupervisor(m ProcessManifest) error {
+	if err := m.validate(); err != nil {
+		return fmt.Errorf("invalid process manifest: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to become subreaper: %w", err)
+	}
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGCHLD}, forwardedSignals...)...)
+	discardCh := make(chan os.Signal, 32)
+	signal.Notify(discardCh, discardedSignals...)
+	restartCh := make(chan *supervisedProcess, len(m.Processes))
+	var procs []*supervisedProcess
+	for _, spec := range m.Processes {
+		procs = append(procs, &supervisedProcess{spec: spec})
+	}
+	byName := map[string]*supervisedProcess{}
+	for _, p := range procs {
+		byName[p.spec.Name] = p
+	}
+	stopping := false
+	failed := 0
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	reap := func() {
+		for {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				return
+			}
+			for _, p := range procs {
+				if p.pid == pid {
+					if code := p.exited(ws, stopping, restartCh); code != 0 && failed == 0 {
+						failed = code
+					}
+				}
+			}
+		}
+	}
+	for {
+		for _, p := range procs {
+			if p.pid != 0 && !p.ready && (p.spec.ReadyPath == "" || pathExists(p.spec.ReadyPath)) {
+				p.ready = true
+			}
+		}
+		active := false
+		for _, p := range procs {
+			if p.finished {
+				continue
+			}
+			if p.pid != 0 {
+				active = true
+				continue
+			}
+			if stopping {
+				p.finished = true
+				continue
+			}
+			startable := true
+			for _, d := range p.spec.DependsOn {
+				dep := byName[d]
+				if dep.finished && !dep.ready {
+					fmt.Printf("Not starting %s since %s exited before it was ready.\n", p.spec.Name, d)
+					p.finished = true
+				}
+				if !dep.ready {
+					startable = false
+				}
+			}
+			if p.finished {
+				continue
+			}
+			active = true
+			if !startable || p.restarting {
+				continue
+			}
+			if err := p.start(); err != nil {
+				fmt.Printf("failed to start %s: %s\n", p.spec.Name, err.Error())
+				p.finished = true
+				if failed == 0 {
+					failed = 127
+				}
+				continue
+			}
+			fmt.Printf("Started %s with PID %d\n", p.spec.Name, p.pid)
+			if p.spec.ReadyPath == "" {
+				p.ready = true
+			}
+		}
+		if !active {
+			if failed != 0 {
+				return ExitCodeError{Code: failed}
+			}
+			return nil
+		}
+		select {
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGCHLD:
+				reap()
+			default:
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+					stopping = true
+				}
+				for _, p := range procs {
+					if p.pid != 0 {
+						// Each process is in its own process group so that its children get the signal as well.
+						_ = syscall.Kill(-p.pid, sig.(syscall.Signal))
+					}
+				}
+			}
+		case p := <-restartCh:
+			p.restarting = false
+			if stopping {
+				p.finished = true
+			}
+		case <-discardCh:
+		case <-ticker.C:
+			// SIGCHLD may be coalesced or missed, e.g. across checkpoint and restore.
+			reap()
+		}
+	}
+}
+
+// start starts the process in its own process group.
+func (p *supervisedProcess) start() error {
+	path, err := exec.LookPath(p.spec.Command[0])
+	if err != nil {
+		return err
+	}
+	proc, err := os.StartProcess(path, p.spec.Command, &os.ProcAttr{
+		Dir:   p.spec.Dir,
+		Env:   append(os.Environ(), p.spec.Env...),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		return err
+	}
+	p.pid = proc.Pid
+	p.started = time.Now()
+	// The process is reaped by the supervisor with wait4 directly.
+	_ = proc.Release()
+	return nil
+}
+
+// exited updates the state of the process once it exits and schedules its restart if needed. It returns the exit
+// code if the process failed for good.
+func (p *supervisedProcess) exited(ws syscall.WaitStatus, stopping bool, restartCh chan<- *supervisedProcess) int {
+	p.pid = 0
+	code := ws.ExitStatus()
+	if ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
+	fmt.Printf("%s exited with code %d\n", p.spec.Name, code)
+	restart := false
+	switch p.spec.RestartPolicy {
+	case RestartPolicyAlways:
+		restart = true
+	case RestartPolicyOnFailure:
+		restart = code != 0
+	}
+	if stopping || !restart {
+		p.finished = true
+		if stopping {
+			return 0
+		}
+		return code
+	}
+	if time.Since(p.started) >= stableRunDuration || p.delay == 0 {
+		p.delay = time.Second
+	} else {
+		p.delay = min(2*p.delay, maxRestartDelay)
+	}
+	p.restarting = true
+	fmt.Printf("Restarting %s in %s\n", p.spec.Name, p.delay)
+	time.AfterFunc(p.delay, func() { restartCh <- p })
+	return 0
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
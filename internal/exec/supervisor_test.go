@@ -0,0 +1,134 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessManifestValidate(t *testing.T) {
+	proc := func(name string, dependsOn ...string) ProcessSpec {
+		return ProcessSpec{Name: name, Command: []string{name}, DependsOn: dependsOn}
+	}
+	tests := []struct {
+		name      string
+		processes []ProcessSpec
+		wantErr   string
+	}{
+		{
+			name:      "single process",
+			processes: []ProcessSpec{proc("app")},
+		},
+		{
+			name:      "dependencies in any order",
+			processes: []ProcessSpec{proc("browser", "xvfb", "dbus"), proc("xvfb"), proc("dbus", "xvfb")},
+		},
+		{
+			name:    "no processes",
+			wantErr: "at least one process is required",
+		},
+		{
+			name:      "missing name",
+			processes: []ProcessSpec{{Command: []string{"app"}}},
+			wantErr:   "name is required",
+		},
+		{
+			name:      "duplicate name",
+			processes: []ProcessSpec{proc("app"), proc("app")},
+			wantErr:   "process app is given more than once",
+		},
+		{
+			name:      "missing command",
+			processes: []ProcessSpec{{Name: "app"}},
+			wantErr:   "command of app is required",
+		},
+		{
+			name:      "unknown restart policy",
+			processes: []ProcessSpec{{Name: "app", Command: []string{"app"}, RestartPolicy: "sometimes"}},
+			wantErr:   `unknown restart policy "sometimes" of app`,
+		},
+		{
+			name:      "unknown dependency",
+			processes: []ProcessSpec{proc("browser", "xvfb")},
+			wantErr:   "browser depends on unknown process xvfb",
+		},
+		{
+			name:      "self dependency",
+			processes: []ProcessSpec{proc("app", "app")},
+			wantErr:   "dependency cycle through app",
+		},
+		{
+			name:      "cycle",
+			processes: []ProcessSpec{proc("a", "b"), proc("b", "c"), proc("c", "a"), proc("d")},
+			wantErr:   "dependency cycle through a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ProcessManifest{Processes: tt.processes}.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadProcessManifest(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, []byte(`processes:
+- name: xvfb
+  command: [Xvfb, ":99"]
+  readyPath: /tmp/.X11-unix/X99
+  restartPolicy: always
+- name: browser
+  command: [chromium]
+  env: [DISPLAY=:99]
+  dependsOn: [xvfb]
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadProcessManifest(valid)
+	if err != nil {
+		t.Fatalf("ReadProcessManifest() error = %v", err)
+	}
+	want := ProcessManifest{Processes: []ProcessSpec{
+		{Name: "xvfb", Command: []string{"Xvfb", ":99"}, ReadyPath: "/tmp/.X11-unix/X99", RestartPolicy: RestartPolicyAlways},
+		{Name: "browser", Command: []string{"chromium"}, Env: []string{"DISPLAY=:99"}, DependsOn: []string{"xvfb"}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadProcessManifest() = %+v, want %+v", got, want)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("processes:\n- name: a\n  command: [a]\n  dependsOn: [a]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadProcessManifest(invalid); err == nil || !strings.Contains(err.Error(), "invalid process manifest") {
+		t.Errorf("ReadProcessManifest() error = %v, want an invalid manifest", err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/timens"
+)
+
+// ClockContinuity decides the values of monotonic clocks of a process restored in a time namespace.
+type ClockContinuity string
+
+// Clock continuity modes.
+const (
+	// ClockContinuityMonotonic makes the monotonic clocks continue from their values at checkpoint time as if no time
+	// has passed while the process was not running. This is what criu does by default.
+	ClockContinuityMonotonic ClockContinuity = "monotonic"
+
+	// ClockContinuityWall advances the monotonic clocks by the wall-clock time that has passed between checkpoint and
+	// restore, so that timeouts that expired in the meantime fire right after restore.
+	ClockContinuityWall ClockContinuity = "wall"
+)
+
+// AdvanceTimeNamespaces adds the given duration to the monotonic and boottime clock values recorded in the time
+// namespace images in the given directory. criu sets the offsets of the restored time namespace using these values.
+// The original images are kept next to the modified ones so that the values are not advanced twice if the restore is
+// retried.
+func AdvanceTimeNamespaces(imageDir string, d time.Duration) error {
+	paths, err := filepath.Glob(filepath.Join(imageDir, "timens-*.img"))
+	if err != nil {
+		return fmt.Errorf("failed to find time namespace images: %w", err)
+	}
+	for _, p := range paths {
+		if err := advanceTimeNamespace(p, d); err != nil {
+			return fmt.Errorf("failed to advance time namespace in %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func advanceTimeNamespace(path string, d time.Duration) error {
+	orig := path + ".orig"
+	if _, err := os.Stat(orig); os.IsNotExist(err) {
+		if err := os.Link(path, orig); err != nil {
+			return fmt.Errorf("failed to keep original image: %w", err)
+		}
+	}
+	in, err := os.Open(orig)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	img, err := crit.New(in, nil, "", false, false).Decode(&timens.TimensEntry{})
+	if err != nil {
+		return fmt.Errorf("failed to decode: %w", err)
+	}
+	for _, e := range img.Entries {
+		entry, ok := e.Message.(*timens.TimensEntry)
+		if !ok {
+			return fmt.Errorf("unexpected entry type %T", e.Message)
+		}
+		advanceTimespec(entry.GetMonotonic(), d)
+		advanceTimespec(entry.GetBoottime(), d)
+	}
+	return writeImage(path, img)
+}
+
+// writeImage encodes the image into a temporary file and renames it over the given path only once it's fully written,
+// so that criu never reads a truncated image.
+func writeImage(path string, img *crit.CriuImage) error {
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := crit.New(nil, out, "", false, false).Encode(img); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to encode: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+func advanceTimespec(ts *timens.Timespec, d time.Duration) {
+	if ts == nil {
+		return
+	}
+	total := time.Duration(ts.GetTvSec())*time.Second + time.Duration(ts.GetTvNsec()) + d
+	sec := uint64(total / time.Second)
+	nsec := uint64(total % time.Second)
+	ts.TvSec = &sec
+	ts.TvNsec = &nsec
+}
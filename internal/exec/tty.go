@@ -0,0 +1,201 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ttyState is the state of the terminal of the process tree recorded during dump.
+type ttyState struct {
+	// Key is the ID of the terminal criu expects in --inherit-fd for the external terminal, see TTYKey.
+	Key string `json:"key"`
+	// Termios is the configuration of the terminal, e.g. whether it echoes the input, set by the process tree.
+	Termios *unix.Termios `json:"termios,omitempty"`
+}
+
+// Pty is a pseudoterminal allocated by crik for the process tree in TTY mode. The process tree gets the slave end as
+// its controlling terminal and crik relays the master end to its own stdio. The slave end is recorded as an external
+// terminal during dump and a new one is given to criu in its place during restore.
+type Pty struct {
+	Master *os.File
+	Slave  *os.File
+
+	// saved is the state of stdin of crik before it's put into raw mode, nil if it's not a terminal.
+	saved *unix.Termios
+	done  chan struct{}
+	once  sync.Once
+}
+
+// OpenPty allocates a new pseudoterminal.
+func OpenPty() (*Pty, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	name := "/dev/pts/" + strconv.Itoa(int(n))
+	slave, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return &Pty{Master: master, Slave: slave, done: make(chan struct{})}, nil
+}
+
+// Attach sets the slave end as the stdio and the controlling terminal of the given command, which must be started in
+// a new session, see NewSysProcAttr.
+func (p *Pty) Attach(cmd *exec.Cmd) {
+	cmd.Stdin = p.Slave
+	cmd.Stdout = p.Slave
+	cmd.Stderr = p.Slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	}
+	cmd.SysProcAttr.Setctty = true
+	// Ctty is the file descriptor number in the child.
+	cmd.SysProcAttr.Ctty = 0
+}
+
+// SetTermios applies the configuration of the terminal recorded during dump.
+func (p *Pty) SetTermios(t *unix.Termios) error {
+	if t == nil {
+		return nil
+	}
+	return unix.IoctlSetTermios(int(p.Master.Fd()), unix.TCSETS, t)
+}
+
+// Start closes the slave end, which the command must have been started with, puts stdin of crik into raw mode if it's
+// a terminal so that the process tree handles the input itself, and starts relaying.
+func (p *Pty) Start() {
+	p.Slave.Close()
+	stdin := int(os.Stdin.Fd())
+	if t, err := unix.IoctlGetTermios(stdin, unix.TCGETS); err == nil {
+		p.saved = t
+		raw := *t
+		raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		raw.Oflag &^= unix.OPOST
+		raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		raw.Cflag &^= unix.CSIZE | unix.PARENB
+		raw.Cflag |= unix.CS8
+		raw.Cc[unix.VMIN] = 1
+		raw.Cc[unix.VTIME] = 0
+		if err := unix.IoctlSetTermios(stdin, unix.TCSETS, &raw); err != nil {
+			fmt.Printf("failed to put terminal into raw mode: %s\n", err.Error())
+		}
+		p.resize()
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		go func() {
+			for {
+				select {
+				case <-winch:
+					p.resize()
+				case <-p.done:
+					signal.Stop(winch)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		_, _ = io.Copy(p.Master, os.Stdin)
+	}()
+	go func() {
+		// Reading the master end fails with EIO once every process holding the slave end has exited.
+		_, _ = io.Copy(os.Stdout, p.Master)
+		p.once.Do(func() { close(p.done) })
+	}()
+}
+
+// resize copies the window size of the terminal of crik to the pty.
+func (p *Pty) resize() {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	_ = unix.IoctlSetWinsize(int(p.Master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// Wait waits until the output is relayed completely and restores the state of the terminal of crik.
+func (p *Pty) Wait() {
+	<-p.done
+	p.restoreTerminal()
+}
+
+// Close closes both ends and restores the state of the terminal of crik.
+func (p *Pty) Close() {
+	p.Slave.Close()
+	p.Master.Close()
+	p.restoreTerminal()
+}
+
+func (p *Pty) restoreTerminal() {
+	if p.saved != nil {
+		_ = unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, p.saved)
+	}
+}
+
+// TTYKey returns the ID criu uses for the terminal at stdin of the given process when it's external to the process
+// tree, i.e. tty[rdev:dev] in hex.
+func TTYKey(pid int) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join("/proc", strconv.Itoa(pid), "fd", "0"), &st); err != nil {
+		return "", fmt.Errorf("failed to stat terminal of %d: %w", pid, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return "", fmt.Errorf("stdin of %d is not a terminal", pid)
+	}
+	return fmt.Sprintf("tty[%x:%x]", st.Rdev, st.Dev), nil
+}
+
+// readTTYState returns the state of the terminal at stdin of the given process.
+func readTTYState(pid int) (*ttyState, error) {
+	key, err := TTYKey(pid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join("/proc", strconv.Itoa(pid), "fd", "0"), os.O_RDONLY|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open terminal of %d: %w", pid, err)
+	}
+	defer f.Close()
+	t, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get terminal configuration of %d: %w", pid, err)
+	}
+	return &ttyState{Key: key, Termios: t}, nil
+}
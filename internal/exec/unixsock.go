@@ -0,0 +1,130 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketDir is a parent directory of a Unix socket bound by the process tree.
+type SocketDir struct {
+	Path string `json:"path"`
+	// Mode is the permission bits of the directory including the sticky, setuid and setgid bits.
+	Mode uint32 `json:"mode"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+// BoundUnixSocketPaths returns the paths the Unix sockets in the checkpoint in the given directory are bound to.
+// Abstract sockets and the ones whose file is deleted are left out.
+func BoundUnixSocketPaths(imageDir string) ([]string, error) {
+	entries, err := decodeFileEntries(filepath.Join(imageDir, "files.img"))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, fe := range entries {
+		usk := fe.GetUsk()
+		name := usk.GetName()
+		if len(name) == 0 || name[0] == 0 || usk.GetDeleted() {
+			continue
+		}
+		p := string(name)
+		if !filepath.IsAbs(p) {
+			// Sockets bound with a relative path have the working directory of the process at that time recorded.
+			p = filepath.Join(usk.GetNameDir(), p)
+		}
+		if filepath.IsAbs(p) {
+			result = append(result, p)
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
+
+// socketParentDirs returns the ancestors of the given socket paths except the root, parents first.
+func socketParentDirs(paths []string) []string {
+	var result []string
+	for _, p := range paths {
+		var chain []string
+		for d := filepath.Dir(p); d != "/" && d != "."; d = filepath.Dir(d) {
+			chain = append(chain, d)
+		}
+		slices.Reverse(chain)
+		for _, d := range chain {
+			if !slices.Contains(result, d) {
+				result = append(result, d)
+			}
+		}
+	}
+	return result
+}
+
+// RecordSocketDirs returns the permissions of the parent directories of the Unix sockets bound by the process tree in
+// the checkpoint so that they can be recreated in the new container.
+func RecordSocketDirs(imageDir string) ([]SocketDir, error) {
+	paths, err := BoundUnixSocketPaths(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	var result []SocketDir
+	for _, d := range socketParentDirs(paths) {
+		var st unix.Stat_t
+		if err := unix.Stat(d, &st); err != nil {
+			continue
+		}
+		result = append(result, SocketDir{Path: d, Mode: st.Mode & 0o7777, UID: int(st.Uid), GID: int(st.Gid)})
+	}
+	return result, nil
+}
+
+// RecreateSocketDirs creates the missing parent directories of the Unix sockets bound by the process tree in the
+// checkpoint, e.g. /tmp/.X11-unix of Xvfb, since criu needs them to bind the sockets again. The permissions recorded
+// during dump are used if available.
+func RecreateSocketDirs(imageDir string, recorded []SocketDir) error {
+	paths, err := BoundUnixSocketPaths(imageDir)
+	if err != nil {
+		return err
+	}
+	for _, d := range socketParentDirs(paths) {
+		if _, err := os.Lstat(d); err == nil {
+			continue
+		}
+		sd := SocketDir{Path: d, Mode: 0o755}
+		if i := slices.IndexFunc(recorded, func(r SocketDir) bool { return r.Path == d }); i >= 0 {
+			sd = recorded[i]
+		}
+		if err := os.Mkdir(d, 0o700); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create %s: %w", d, err)
+		}
+		if err := unix.Lchown(d, sd.UID, sd.GID); err != nil && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EINVAL) {
+			// Like in applyMetadata, the directory is owned by crik's user if it cannot change the owner.
+			return fmt.Errorf("failed to change owner of %s: %w", d, err)
+		}
+		// Chmod is needed since umask applies on creation and to set the sticky bit, e.g. of /tmp/.X11-unix.
+		if err := unix.Chmod(d, sd.Mode); err != nil {
+			return fmt.Errorf("failed to change mode of %s: %w", d, err)
+		}
+	}
+	return nil
+}
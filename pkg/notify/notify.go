@@ -0,0 +1,168 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package notify lets applications wrapped by crik learn that they are about to be checkpointed, that a checkpoint
+// was aborted or that they have been restored in a new pod.
+//
+// crik advertises the protocol to the wrapped process with environment variables. The state file named by
+// CRIK_STATE_FILE always contains the latest event and, if CRIK_NOTIFY_SIGNAL is set, crik sends that signal to the
+// wrapped process every time it updates the file.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// EnvStateFile is the environment variable that contains the path of the state file.
+	EnvStateFile = "CRIK_STATE_FILE"
+
+	// EnvSignal is the environment variable that contains the name of the signal, e.g. SIGUSR2, that crik sends to
+	// the wrapped process after updating the state file. It is not set if crik is not configured to send a signal.
+	EnvSignal = "CRIK_NOTIFY_SIGNAL"
+)
+
+// Event is the kind of the notification.
+type Event string
+
+// Events that crik announces.
+const (
+	// EventCheckpointing is announced right before crik starts taking the checkpoint.
+	EventCheckpointing Event = "checkpointing"
+
+	// EventCheckpointAborted is announced when the checkpoint could not be taken and the process keeps running.
+	EventCheckpointAborted Event = "checkpoint-aborted"
+
+	// EventRestored is announced after the process has been restored from a checkpoint.
+	EventRestored Event = "restored"
+)
+
+// State is the content of the state file.
+type State struct {
+	// Event is the latest event.
+	Event Event `json:"event"`
+
+	// Generation is the number of times the process has been restored.
+	Generation int `json:"generation"`
+
+	// PodName is the name of the pod the process is running in.
+	PodName string `json:"podName,omitempty"`
+
+	// NodeName is the name of the node the process is running on.
+	NodeName string `json:"nodeName,omitempty"`
+
+	// Timestamp is the time the event happened.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReadState reads the state file in the given path.
+func ReadState(path string) (State, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return State{}, fmt.Errorf("failed to unmarshal state file: %w", err)
+	}
+	return s, nil
+}
+
+// WriteState atomically replaces the state file in the given path so that readers never see a partial write.
+func WriteState(path string, s State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory of state file: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename state file: %w", err)
+	}
+	return nil
+}
+
+// ParseSignal returns the signal with the given name, e.g. SIGUSR2.
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// Watch returns a channel that receives the state every time crik announces an event. It uses the signal advertised
+// in CRIK_NOTIFY_SIGNAL if available and polls the state file every pollInterval otherwise. The channel is closed
+// when the context is cancelled.
+// It returns an error if the process is not wrapped by crik with notifications enabled.
+func Watch(ctx context.Context, pollInterval time.Duration) (<-chan State, error) {
+	path := os.Getenv(EnvStateFile)
+	if path == "" {
+		return nil, fmt.Errorf("%s is not set, notifications are not enabled", EnvStateFile)
+	}
+	var sigCh chan os.Signal
+	if name := os.Getenv(EnvSignal); name != "" {
+		sig, err := ParseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+		sigCh = make(chan os.Signal, 1)
+		signal.Notify(sigCh, sig)
+	}
+	last, _ := ReadState(path)
+	ch := make(chan State, 1)
+	go func() {
+		defer close(ch)
+		if sigCh != nil {
+			defer signal.Stop(sigCh)
+		}
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+			case <-ticker.C:
+			}
+			s, err := ReadState(path)
+			if err != nil || s == last {
+				continue
+			}
+			last = s
+			select {
+			case ch <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2024 QA Wolf Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{name: "SIGUSR1", want: syscall.SIGUSR1},
+		{name: "SIGUSR2", want: syscall.SIGUSR2},
+		{name: "SIGTERM", want: syscall.SIGTERM},
+		{name: "SIGRTMIN", wantErr: true},
+		{name: "USR2", wantErr: true},
+		{name: "sigusr2", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSignal(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSignal(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSignal(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteStateReadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "state.json")
+	want := State{
+		Event:      EventRestored,
+		Generation: 3,
+		PodName:    "pod",
+		NodeName:   "node",
+		Timestamp:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := WriteState(path, want); err != nil {
+		t.Fatalf("WriteState() error = %v", err)
+	}
+	got, err := ReadState(path)
+	if err != nil {
+		t.Fatalf("ReadState() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("ReadState() = %+v, want %+v", got, want)
+	}
+	if _, err := ReadState(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("ReadState() of a missing file succeeded")
+	}
+}